@@ -0,0 +1,93 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "syscall"
+    "time"
+    "github.com/ircop/smtp2tg/hooks"
+    "github.com/ircop/smtp2tg/smtpd"
+)
+
+// archiveSeq tells apart maildir files written in the same second.
+var archiveSeq int64
+
+// mboxMu serializes appends to the mbox within the process, flock keeps
+// other mail readers and writers out.
+var mboxMu sync.Mutex
+
+// mboxFromRE matches the body lines to quote in an mbox (mboxrd format).
+var mboxFromRE = regexp.MustCompile(`(?m)^(>*From )`)
+
+// maildirArchiver returns a received hook storing every mail in the
+// maildir at dir, creating its cur, new and tmp directories.
+func maildirArchiver(dir string) (func(ev *hooks.Event), error) {
+    for _, sub := range []string{"cur", "new", "tmp"} {
+	if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+	    return nil, err
+	}
+    }
+    host, _ := os.Hostname()
+    host = strings.NewReplacer("/", "\\057", ":", "\\072").Replace(host)
+    return func(ev *hooks.Event) {
+	// Written to tmp, then moved to new: readers never see a partial mail.
+	name := fmt.Sprintf("%d.P%dQ%d.%s", time.Now().Unix(), os.Getpid(), atomic.AddInt64(&archiveSeq, 1), host)
+	tmp := filepath.Join(dir, "tmp", name)
+	if err := ioutil.WriteFile(tmp, ev.Env.Data, 0600); err != nil {
+	    logError("maildir archive: %s", err.Error())
+	    return
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, "new", name)); err != nil {
+	    logError("maildir archive: %s", err.Error())
+	    os.Remove(tmp)
+	}
+    }, nil
+}
+
+// mboxArchiver returns a received hook appending every mail to the mbox
+// at path.
+func mboxArchiver(path string) func(ev *hooks.Event) {
+    return func(ev *hooks.Event) {
+	if err := appendMbox(path, ev.Env); err != nil {
+	    logError("mbox archive: %s", err.Error())
+	}
+    }
+}
+
+// appendMbox appends the mail to the mbox, holding an exclusive flock on
+// it meanwhile.
+func appendMbox(path string, env *smtpd.Envelope) error {
+    sender := strings.Trim(env.From, " <>")
+    if( sender == "" ) {
+	sender = "MAILER-DAEMON"
+    }
+    var b bytes.Buffer
+    fmt.Fprintf(&b, "From %s %s\n", sender, env.Received.Format(time.ANSIC))
+    data := bytes.Replace(env.Data, []byte("\r\n"), []byte("\n"), -1)
+    b.Write(mboxFromRE.ReplaceAll(data, []byte(">$1")))
+    if( !bytes.HasSuffix(data, []byte("\n")) ) {
+	b.WriteByte('\n')
+    }
+    b.WriteByte('\n')
+
+    mboxMu.Lock()
+    defer mboxMu.Unlock()
+    f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+    if( err != nil ) {
+	return err
+    }
+    defer f.Close()
+    if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+	return err
+    }
+    defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+    _, err = f.Write(b.Bytes())
+    return err
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "sort"
+    "strconv"
+    "strings"
+    "gopkg.in/telegram-bot-api.v4"
+)
+
+// admins holds the chat ids allowed to use bot commands.
+var admins map[int64]bool
+
+// loadAdmins parses the bot.admins chat id list.
+func loadAdmins(list []string) {
+    admins = make(map[int64]bool)
+    for _, s := range list {
+	id, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if( err != nil ) {
+	    log.Fatalf("Wrong bot.admins chat id '%s': not int64", s)
+	}
+	admins[id] = true
+    }
+}
+
+// serveCommands answers the commands sent to the bot by admin chats. When
+// the bot is re-created (after a token rotation), it polls with the new one.
+func serveCommands(t *telegramSender) {
+    for {
+	changed := t.botChanged()
+	bot := t.api()
+	u := tgbotapi.NewUpdate(0)
+	u.Timeout = 60
+	updates, err := bot.GetUpdatesChan(u)
+	if( err != nil ) {
+	    logError("telegram updates: %s", err.Error())
+	    <-changed
+	    continue
+	}
+	serveUpdates(bot, updates, changed)
+	bot.StopReceivingUpdates()
+    }
+}
+
+// serveUpdates answers the commands of updates until the bot is replaced.
+func serveUpdates(bot *tgbotapi.BotAPI, updates tgbotapi.UpdatesChannel, changed <-chan struct{}) {
+    for {
+	var update tgbotapi.Update
+	var ok bool
+	select {
+	case update, ok = <-updates:
+	    if( !ok ) {
+		// Polling stopped: wait for another bot.
+		<-changed
+		return
+	    }
+	case <-changed:
+	    return
+	}
+	if update.Message == nil || update.Message.Chat == nil || !update.Message.IsCommand() {
+	    continue
+	}
+	chat := update.Message.Chat.ID
+	if( !admins[chat] ) {
+	    log.Printf("Ignoring /%s from non-admin chat %d", update.Message.Command(), chat)
+	    continue
+	}
+	var reply string
+	switch update.Message.Command() {
+	case "routes":
+	    reply = routesText()
+	default:
+	    reply = "Unknown command. Available: /routes"
+	}
+	if _, err := bot.Send(tgbotapi.NewMessage(chat, reply)); err != nil {
+	    logError("telegram command reply: '%s'", err.Error())
+	}
+    }
+}
+
+// routesText lists the configured receiver to destination mapping.
+func routesText() string {
+    keys := make([]string, 0, len(receivers))
+    for key := range receivers {
+	keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    var b strings.Builder
+    for _, key := range keys {
+	backend := receiverBackend(key)
+	if( backend == "telegram" ) {
+	    fmt.Fprintf(&b, "%s -> %s\n", key, receivers[key])
+	} else {
+	    // Webhook urls carry credentials, don't print them.
+	    fmt.Fprintf(&b, "%s -> %s webhook\n", key, backend)
+	}
+    }
+    return b.String()
+}
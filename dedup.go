@@ -0,0 +1,68 @@
+package main
+
+import (
+    "strings"
+    "sync"
+    "time"
+)
+
+// dedupWindow is how long a Message-ID is remembered, mail carrying one
+// seen within it isn't relayed again. Disabled if 0.
+var dedupWindow time.Duration
+
+// seen holds the Message-IDs delivered within dedupWindow, by route, with
+// when they were.
+var seen struct {
+    mu     sync.Mutex
+    ids    map[string]time.Time
+    pruned time.Time
+}
+
+// dedupKey is the key of a Message-ID delivered to the route, empty for
+// mail without one. MTAs split mail into a transaction per recipient with
+// the same Message-ID: copies routed elsewhere aren't duplicates.
+func dedupKey(messageID string, r *route) string {
+    id := strings.TrimSpace(messageID)
+    if( dedupWindow <= 0 || id == "" ) {
+	return ""
+    }
+    return id + "\x00" + r.Key + "\x00" + r.Dest
+}
+
+// duplicate reports whether the Message-ID was delivered to the route
+// within dedupWindow. Mail without one is never a duplicate.
+func duplicate(messageID string, r *route) bool {
+    key := dedupKey(messageID, r)
+    if( key == "" ) {
+	return false
+    }
+    seen.mu.Lock()
+    defer seen.mu.Unlock()
+    at, ok := seen.ids[key]
+    return ok && time.Since(at) <= dedupWindow
+}
+
+// rememberDelivered records the Message-ID as delivered to the route.
+// Only delivered mail is: a resend of mail that failed is relayed again.
+func rememberDelivered(messageID string, r *route) {
+    key := dedupKey(messageID, r)
+    if( key == "" ) {
+	return
+    }
+    now := time.Now()
+    seen.mu.Lock()
+    defer seen.mu.Unlock()
+    if( seen.ids == nil ) {
+	seen.ids = map[string]time.Time{}
+    }
+    // Forget expired ids now and then, rather than on every mail.
+    if( now.Sub(seen.pruned) > dedupWindow ) {
+	for key, at := range seen.ids {
+	    if( now.Sub(at) > dedupWindow ) {
+		delete(seen.ids, key)
+	    }
+	}
+	seen.pruned = now
+    }
+    seen.ids[key] = now
+}
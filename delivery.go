@@ -0,0 +1,110 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "net/mail"
+    "net/smtp"
+    "strings"
+    "time"
+    "github.com/ircop/smtp2tg/hooks"
+)
+
+// mdnReceivers are the receiver keys ("*" for all) whose mail may get
+// delivery notifications. None does if empty.
+var mdnReceivers map[string]bool
+
+// mdnRecipient returns the address to notify of the delivery of the mail,
+// or an empty string if it gets no notification. Only mail of receivers
+// in mdnReceivers asking for one with Disposition-Notification-To does,
+// and only if it names the envelope sender (RFC 8098 section 2.1):
+// notifying whatever sender a forged mail claims would be backscatter.
+func mdnRecipient(in *hooks.Mail, r *hooks.Route) string {
+    if( !mdnReceivers[r.Key] && !mdnReceivers["*"] ) {
+	return ""
+    }
+    sender := strings.Trim(in.From, " <>")
+    // Never answer bounces or automatic mail, loops are worse than silence.
+    auto := in.Msg.Header.Get("Auto-Submitted")
+    if( sender == "" || (auto != "" && auto != "no") ) {
+	return ""
+    }
+    dnt := in.Msg.Header.Get("Disposition-Notification-To")
+    if( dnt == "" ) {
+	return ""
+    }
+    addr, err := mail.ParseAddress(dnt)
+    if( err != nil || !strings.EqualFold(addr.Address, sender) ) {
+	log.Printf("Not sending a delivery notification to '%s': not the envelope sender '%s'", dnt, sender)
+	return ""
+    }
+    return sender
+}
+
+// mdnSender returns a delivery hook mailing a notification to the
+// envelope sender through the relay at addr ("host:port"), if the mail
+// asks for one (see mdnRecipient).
+func mdnSender(addr string, from string) func(in *hooks.Mail, r *hooks.Route) {
+    return func(in *hooks.Mail, r *hooks.Route) {
+	sender := mdnRecipient(in, r)
+	if( sender == "" ) {
+	    return
+	}
+	body := fmt.Sprintf("From: %s\r\n"+
+	    "To: %s\r\n"+
+	    "Subject: Delivered: %s\r\n"+
+	    "Date: %s\r\n"+
+	    "Auto-Submitted: auto-replied\r\n"+
+	    "Content-Type: text/plain; charset=utf-8\r\n"+
+	    "\r\n"+
+	    "Your message to %s was relayed to %s.\r\n",
+	    from, sender, in.Msg.Header.Get("Subject"), time.Now().Format(time.RFC1123Z), strings.Join(in.To, ", "), r.Backend)
+	if err := smtp.SendMail(addr, nil, from, []string{sender}, []byte(body)); err != nil {
+	    logError("delivery notification to %s: %s", sender, err.Error())
+	    return
+	}
+	log.Printf("Sent delivery notification to %s", sender)
+    }
+}
+
+// relayAddr is the "host:port" of the SMTP relay mail is forwarded to,
+// relayModes maps receivers to how: "also" after telegram, or "only".
+var relayAddr string
+var relayModes map[string]string
+
+// relayMode returns how mail of the receiver key is forwarded to the
+// SMTP relay, or an empty string if it isn't.
+func relayMode(key string) string {
+    if( relayAddr == "" ) {
+	return ""
+    }
+    if mode, ok := relayModes[key]; ok {
+	return mode
+    }
+    return relayModes["*"]
+}
+
+// forwardToRelay sends the mail as received to its envelope recipients
+// through the SMTP relay.
+func forwardToRelay(in *hooks.Mail) error {
+    if( in.Env == nil ) {
+	return fmt.Errorf("not received by SMTP, no raw mail to forward")
+    }
+    from := strings.Trim(in.From, " <>")
+    if err := smtp.SendMail(relayAddr, nil, from, in.To, in.Env.Data); err != nil {
+	return err
+    }
+    log.Printf("Forwarded mail from '%s' for '%s' to %s", in.From, strings.Join(in.To, ", "), relayAddr)
+    return nil
+}
+
+// relayForwarder is a delivery hook forwarding mail of receivers relayed
+// "also" to the SMTP relay.
+func relayForwarder(in *hooks.Mail, r *hooks.Route) {
+    if( relayMode(r.Key) != "also" ) {
+	return
+    }
+    if err := forwardToRelay(in); err != nil {
+	logError("relay forward to %s: %s", relayAddr, err.Error())
+    }
+}
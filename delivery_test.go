@@ -0,0 +1,34 @@
+package main
+
+import (
+    "testing"
+    "github.com/ircop/smtp2tg/hooks"
+    "github.com/veqryn/go-email/email"
+)
+
+func TestMDNRecipient(t *testing.T) {
+    saved := mdnReceivers
+    defer func() { mdnReceivers = saved }()
+    mdnReceivers = map[string]bool{"support@example.org": true}
+
+    route := &hooks.Route{Key: "support@example.org"}
+    for _, c := range []struct {
+	name   string
+	from   string
+	header email.Header
+	route  *hooks.Route
+	want   string
+    }{
+	{"no Disposition-Notification-To", "<a@example.com>", email.Header{}, route, ""},
+	{"asked by the sender", "<a@example.com>", email.Header{"Disposition-Notification-To": {"A <A@example.com>"}}, route, "a@example.com"},
+	{"asked for someone else", "<a@example.com>", email.Header{"Disposition-Notification-To": {"victim@example.net"}}, route, ""},
+	{"receiver not opted in", "<a@example.com>", email.Header{"Disposition-Notification-To": {"a@example.com"}}, &hooks.Route{Key: "*"}, ""},
+	{"null sender", "<>", email.Header{"Disposition-Notification-To": {"a@example.com"}}, route, ""},
+	{"automatic mail", "<a@example.com>", email.Header{"Disposition-Notification-To": {"a@example.com"}, "Auto-Submitted": {"auto-generated"}}, route, ""},
+    } {
+	in := &hooks.Mail{From: c.from, Msg: &email.Message{Header: c.header}}
+	if got := mdnRecipient(in, c.route); got != c.want {
+	    t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+	}
+    }
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+    "bytes"
+    "compress/gzip"
+    "fmt"
+    "net/mail"
+    "net/textproto"
+    "regexp"
+    "sort"
+    "strings"
+    "time"
+    "unicode/utf8"
+    "github.com/veqryn/go-email/email"
+)
+
+var showDate bool
+var showFrom bool
+var showTxID bool
+var includeSummary bool
+var preserveNewlines bool
+var dateLocation = time.UTC
+var longBody string
+var longBodyLimit = 4096
+
+// longBodies and longBodyLimits map receivers to their own long_body
+// strategy and limit, overriding the bot ones.
+var longBodies map[string]string
+var longBodyLimits = map[string]int{}
+var showHeaders []string
+var collapseBlanks bool
+
+// prefixes maps receivers to the label (e.g. an emoji) their text starts with.
+var prefixes map[string]string
+
+// blankRunRE matches 3 or more line breaks with only blanks between them.
+var blankRunRE = regexp.MustCompile(`(\r?\n[ \t]*){3,}`)
+var headersMode string
+
+// idTag returns " (id ...)" for log lines about mail with a transaction
+// id, an empty string otherwise.
+func idTag(in *inbound) string {
+    if( in.ID == "" ) {
+	return ""
+    }
+    return " (id " + in.ID + ")"
+}
+
+// dateLine returns the original Date: header of the message in dateLocation,
+// as sent if it can't be parsed, or an empty string if it is missing.
+func dateLine(msg *email.Message) string {
+    raw := strings.TrimSpace(msg.Header.Get("Date"))
+    if( raw == "" ) {
+	return ""
+    }
+    date, err := mail.ParseDate(raw)
+    if( err != nil ) {
+	// Odd, but still better than no date at all.
+	return raw
+    }
+    return date.In(dateLocation).Format("2006-01-02 15:04:05 MST")
+}
+
+// senderName returns the display name of the From: header, falling back to
+// its address, then to the envelope sender.
+func senderName(in *inbound) string {
+    addr, err := mail.ParseAddress(in.Msg.Header.Get("From"))
+    if( err != nil ) {
+	return strings.Trim(in.From, "<>")
+    }
+    if( addr.Name != "" ) {
+	return addr.Name
+    }
+    return addr.Address
+}
+
+// formatBody prepares the text of the mail for relaying.
+func formatBody(in *inbound, body string) string {
+    msg := in.Msg
+    if( collapseBlanks ) {
+	body = blankRunRE.ReplaceAllString(body, "\n\n")
+    }
+    if( preserveNewlines ) {
+	body = codeBlock(body)
+    }
+    if( showDate ) {
+	if date := dateLine(msg); date != "" {
+	    body = date + "\n" + body
+	}
+    }
+    if( showFrom ) {
+	if name := senderName(in); name != "" {
+	    body = "From: " + name + "\n" + body
+	}
+    }
+    if( includeSummary ) {
+	body += "\n\n" + summaryFooter(msg, in.Size)
+    }
+    if( showTxID && in.ID != "" ) {
+	body += "\n\nid: " + in.ID
+    }
+    if( in.SPF != "" ) {
+	body = "⚠️ SPF " + in.SPF + ", the sender may be forged\n" + body
+    }
+    return body
+}
+
+// withPrefix starts the text with the prefix configured for the receiver
+// key, or the wildcard one.
+func withPrefix(key string, text string) string {
+    prefix := prefixes[key]
+    if( prefix == "" ) {
+	prefix = prefixes["*"]
+    }
+    if( prefix == "" ) {
+	return text
+    }
+    if strings.HasPrefix(text, "```") {
+	// Keep the fence at the start of its line.
+	return prefix + "\n" + text
+    }
+    return prefix + " " + text
+}
+
+// longBodySummary is the text sent in place of a body too long for
+// long_body: the beginning of the body, the full one follows as the
+// document name.
+func longBodySummary(in *inbound, body string, name string) string {
+    lines := strings.SplitN(strings.TrimSpace(body), "\n", 6)
+    if len(lines) > 5 {
+	lines = lines[:5]
+    }
+    head := strings.Join(lines, "\n")
+    if runes := []rune(head); len(runes) > 500 {
+	head = string(runes[:500])
+    }
+    summary := head + "\n…\n(" + humanSize(len(body)) + ", full text attached as " + name + ")"
+    if subject := in.Msg.Header.Get("Subject"); subject != "" {
+	summary = "Subject: " + subject + "\n" + summary
+    }
+    if( showFrom ) {
+	if name := senderName(in); name != "" {
+	    summary = "From: " + name + "\n" + summary
+	}
+    }
+    return summary
+}
+
+// headerBlock lists the headers of the message named in showHeaders
+// ("*" for all of them), one "Name: value" line per value.
+func headerBlock(msg *email.Message) string {
+    var names []string
+    for _, name := range showHeaders {
+	if( name == "*" ) {
+	    names = names[:0]
+	    for key := range msg.Header {
+		names = append(names, key)
+	    }
+	    sort.Strings(names)
+	    break
+	}
+	names = append(names, textproto.CanonicalMIMEHeaderKey(name))
+    }
+    var lines []string
+    for _, name := range names {
+	for _, value := range msg.Header[name] {
+	    lines = append(lines, name+": "+value)
+	}
+    }
+    return strings.Join(lines, "\n")
+}
+
+// longBodyMode returns the long_body strategy of the receiver key, or
+// the wildcard one, or the bot one.
+func longBodyMode(key string) string {
+    if mode, ok := longBodies[key]; ok {
+	return mode
+    }
+    if mode, ok := longBodies["*"]; ok {
+	return mode
+    }
+    return longBody
+}
+
+// longBodyMax returns the long_body_limit of the receiver key, or the
+// wildcard one, or the bot one.
+func longBodyMax(key string) int {
+    if limit, ok := longBodyLimits[key]; ok {
+	return limit
+    }
+    if limit, ok := longBodyLimits["*"]; ok {
+	return limit
+    }
+    return longBodyLimit
+}
+
+// validLongBody reports whether mode is a known long_body strategy.
+func validLongBody(mode string) bool {
+    switch mode {
+    case "", "document", "gzip", "split", "truncate":
+	return true
+    }
+    return false
+}
+
+// truncateText cuts text to at most limit bytes, ending with an ellipsis,
+// without cutting a character in two.
+func truncateText(text string, limit int) string {
+    const ellipsis = "…"
+    if( len(text) <= limit ) {
+	return text
+    }
+    cut := limit - len(ellipsis)
+    if( cut < 0 ) {
+	cut = 0
+    }
+    for cut > 0 && !utf8.RuneStart(text[cut]) {
+	cut--
+    }
+    return text[:cut] + ellipsis
+}
+
+// splitText cuts text into messages of at most limit bytes, at a line
+// break where there is one in the second half of the chunk.
+func splitText(text string, limit int) []string {
+    var chunks []string
+    for len(text) > limit {
+	cut := limit
+	if nl := strings.LastIndex(text[:limit], "\n"); nl >= limit/2 {
+	    cut = nl + 1
+	}
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+	    cut--
+	}
+	if( cut == 0 ) {
+	    // Limit smaller than a character: send it whole.
+	    _, cut = utf8.DecodeRuneInString(text)
+	}
+	chunks = append(chunks, text[:cut])
+	text = text[cut:]
+    }
+    if( text != "" || len(chunks) == 0 ) {
+	chunks = append(chunks, text)
+    }
+    return chunks
+}
+
+// longBodyName is the name of the document long bodies are sent as.
+func longBodyName(mode string) string {
+    if( mode == "gzip" ) {
+	return "message.txt.gz"
+    }
+    return "message.txt"
+}
+
+// gzipText compresses a body sent with long_body = gzip.
+func gzipText(data []byte) []byte {
+    var b bytes.Buffer
+    zw := gzip.NewWriter(&b)
+    zw.Write(data)
+    zw.Close()
+    return b.Bytes()
+}
+
+// codeBlock wraps text into a markdown code block, so log-like bodies keep
+// their line structure and alignment.
+func codeBlock(text string) string {
+    // A fence inside would end the block early.
+    text = strings.Replace(text, "```", "'''", -1)
+    return "```\n" + strings.TrimRight(text, "\r\n") + "\n```"
+}
+
+// summaryFooter lists the attachments of the message with their sizes,
+// and the size of the whole mail.
+func summaryFooter(msg *email.Message, size int) string {
+    var files []string
+    for _, part := range leafParts(msg) {
+	disposition, _, _ := part.Header.ContentDisposition()
+	if disposition != "attachment" && strings.HasPrefix(partType(part), "text") {
+	    continue
+	}
+	files = append(files, fmt.Sprintf("%s (%s)", partFilename(part), humanSize(len(part.Body))))
+    }
+    footer := "Size: " + humanSize(size)
+    if len(files) > 0 {
+	footer = "Attachments: " + strings.Join(files, ", ") + "\n" + footer
+    }
+    return footer
+}
+
+// humanSize formats a byte count as B/KB/MB.
+func humanSize(n int) string {
+    switch {
+    case n >= 1<<20:
+	return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+    case n >= 1<<10:
+	return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+    }
+    return fmt.Sprintf("%d B", n)
+}
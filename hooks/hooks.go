@@ -0,0 +1,113 @@
+// Package hooks lets code built into smtp2tg follow the delivery of every
+// mail: metrics, auditing or notifications register callbacks here rather
+// than going into the SMTP handler itself.
+//
+// Hooks run synchronously, on the goroutine handling the mail, in the order
+// registered. For mail received over SMTP it is the smtpd handler
+// goroutine; for /submit a goroutine started after the HTTP reply was sent,
+// which holds a handler slot of the SMTP server as well. A slow hook delays
+// the delivery of the mail and holds its handler slot; start a goroutine
+// for slow work.
+package hooks
+
+import (
+    "sync"
+    "github.com/ircop/smtp2tg/smtpd"
+    "github.com/veqryn/go-email/email"
+)
+
+// Lifecycle events of a mail.
+const (
+    Received  = "received"  // Accepted over SMTP, not parsed yet
+    Parsed    = "parsed"    // Parsed, about to be routed and relayed
+    Delivered = "delivered" // Relayed to its destination
+    Failed    = "failed"    // Lost: unparsable, or the backend refused it
+)
+
+// Mail is a parsed mail to relay, whatever way it was received.
+type Mail struct {
+    From string          // Envelope sender
+    To   []string        // Envelope recipients
+    Msg  *email.Message
+    Size int             // Size of the raw mail
+    Port string          // Port of the SMTP listener, empty if not received by SMTP
+    SPF  string          // SPF result the mail is tagged with, if any
+    Helo string          // EHLO/HELO name of the SMTP client
+    ID   string          // SMTP transaction id, empty if not received by SMTP
+    Env  *smtpd.Envelope // SMTP transaction, nil if not received by SMTP
+}
+
+// Route is the destination a mail was resolved to.
+type Route struct {
+    Key     string // [receivers] key the mail matched, "*" for wildcard
+    Dest    string // Chat id or webhook url
+    Backend string // Name of the backend: telegram, slack or discord
+    Wrap    string // Overrides the receiver wrap of telegram text if set
+    Thread  int    // Telegram forum topic, the general one if 0
+}
+
+// Event tells a hook about a step of the delivery of a mail. Fields are
+// nil until the step providing them.
+type Event struct {
+    Name   string
+    Env    *smtpd.Envelope // SMTP transaction, nil for http submissions
+    Mail   *Mail           // Parsed mail
+    Route  *Route          // Where it was relayed to
+    Status string          // Delivery status of delivered and failed events
+}
+
+// Hook is called with the events it was registered for.
+type Hook func(ev *Event)
+
+// Bus holds the hooks registered for each event name. The zero value is
+// ready to use.
+type Bus struct {
+    mu    sync.RWMutex
+    hooks map[string][]Hook
+}
+
+// On registers a hook for the event name.
+func (b *Bus) On(name string, hook Hook) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if b.hooks == nil {
+	b.hooks = map[string][]Hook{}
+    }
+    b.hooks[name] = append(b.hooks[name], hook)
+}
+
+// OnDelivered registers a hook called after a mail was relayed successfully.
+func (b *Bus) OnDelivered(hook func(m *Mail, r *Route)) {
+    b.On(Delivered, func(ev *Event) {
+	hook(ev.Mail, ev.Route)
+    })
+}
+
+// Emit runs the hooks registered for the event, returning once they all
+// returned.
+func (b *Bus) Emit(ev *Event) {
+    b.mu.RLock()
+    hooks := b.hooks[ev.Name]
+    b.mu.RUnlock()
+    for _, hook := range hooks {
+	hook(ev)
+    }
+}
+
+// DefaultBus is the bus smtp2tg emits its events on.
+var DefaultBus = &Bus{}
+
+// On registers a hook for the event name on DefaultBus.
+func On(name string, hook Hook) {
+    DefaultBus.On(name, hook)
+}
+
+// OnDelivered registers a delivered hook on DefaultBus.
+func OnDelivered(hook func(m *Mail, r *Route)) {
+    DefaultBus.OnDelivered(hook)
+}
+
+// Emit runs the hooks registered on DefaultBus for the event.
+func Emit(ev *Event) {
+    DefaultBus.Emit(ev)
+}
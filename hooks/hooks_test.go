@@ -0,0 +1,41 @@
+package hooks
+
+import (
+    "reflect"
+    "testing"
+)
+
+// Hooks of an event run in the order registered, before Emit returns.
+func TestEmitOrder(t *testing.T) {
+    var b Bus
+    var calls []string
+    b.On(Received, func(ev *Event) { calls = append(calls, "first") })
+    b.On(Received, func(ev *Event) { calls = append(calls, "second") })
+    b.On(Failed, func(ev *Event) { calls = append(calls, "failed") })
+    b.Emit(&Event{Name: Received})
+    if want := []string{"first", "second"}; !reflect.DeepEqual(calls, want) {
+	t.Errorf("calls %q, want %q", calls, want)
+    }
+}
+
+func TestOnDelivered(t *testing.T) {
+    var b Bus
+    mail, route := &Mail{From: "a@example.com"}, &Route{Key: "*", Dest: "1"}
+    var got *Mail
+    var gotRoute *Route
+    b.OnDelivered(func(m *Mail, r *Route) { got, gotRoute = m, r })
+    b.Emit(&Event{Name: Failed, Mail: mail, Route: route})
+    if got != nil {
+	t.Fatal("delivered hook called for a failed mail")
+    }
+    b.Emit(&Event{Name: Delivered, Mail: mail, Route: route})
+    if got != mail || gotRoute != route {
+	t.Errorf("hook called with %v %v, want %v %v", got, gotRoute, mail, route)
+    }
+}
+
+// Emit without any hook registered does nothing.
+func TestEmitNone(t *testing.T) {
+    var b Bus
+    b.Emit(&Event{Name: Parsed})
+}
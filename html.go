@@ -0,0 +1,230 @@
+package main
+
+import (
+    "strings"
+    "unicode/utf8"
+    "golang.org/x/net/html"
+)
+
+// renderTables makes tables of html bodies be rendered as aligned
+// monospace code blocks.
+var renderTables bool
+
+// htmlTable collects the cells of a table being converted.
+type htmlTable struct {
+    rows   [][]string
+    header bool // First row is made of <th> cells
+    cell   strings.Builder
+    inCell bool
+}
+
+// htmlToText converts an html body to plain text, keeping line structure
+// of block elements. Tables are rendered as code blocks with aligned
+// columns if renderTables is set.
+func htmlToText(body string) string {
+    var out strings.Builder
+    var table *htmlTable
+    depth := 0 // Table nesting, inner tables are flattened into cells
+    skip := 0  // Inside <script> or <style>
+
+    z := html.NewTokenizer(strings.NewReader(body))
+    for {
+	tt := z.Next()
+	switch tt {
+	case html.ErrorToken:
+	    if table != nil {
+		out.WriteString(table.render())
+	    }
+	    return tidyLines(out.String())
+	case html.TextToken:
+	    if skip > 0 {
+		continue
+	    }
+	    text := collapseSpaces(string(z.Text()))
+	    if table != nil {
+		if table.inCell {
+		    table.cell.WriteString(text)
+		}
+	    } else {
+		out.WriteString(text)
+	    }
+	case html.StartTagToken, html.SelfClosingTagToken, html.EndTagToken:
+	    name, _ := z.TagName()
+	    tag := string(name)
+	    end := tt == html.EndTagToken
+	    if tag == "script" || tag == "style" {
+		if !end {
+		    skip++
+		} else if skip > 0 {
+		    skip--
+		}
+		continue
+	    }
+	    if tag == "table" && renderTables {
+		if !end {
+		    depth++
+		    if depth == 1 {
+			table = &htmlTable{}
+		    }
+		} else if depth > 0 {
+		    depth--
+		    if depth == 0 && table != nil {
+			out.WriteString(table.render())
+			table = nil
+		    }
+		}
+		continue
+	    }
+	    if table != nil && depth == 1 {
+		table.tag(tag, end)
+		continue
+	    }
+	    if table != nil {
+		if table.inCell && (tag == "br" || tag == "td" || tag == "th") {
+		    table.cell.WriteString(" ")
+		}
+		continue
+	    }
+	    switch tag {
+	    case "br", "p", "div", "tr", "li", "h1", "h2", "h3", "h4", "h5", "h6", "table", "hr":
+		out.WriteString("\n")
+	    case "td", "th":
+		if !end {
+		    out.WriteString(" ")
+		}
+	    }
+	}
+    }
+}
+
+// tag handles a structural tag of the table.
+func (t *htmlTable) tag(tag string, end bool) {
+    switch tag {
+    case "tr":
+	t.endCell()
+	if !end {
+	    t.rows = append(t.rows, nil)
+	}
+    case "td", "th":
+	t.endCell()
+	if !end {
+	    if len(t.rows) == 0 {
+		t.rows = append(t.rows, nil)
+	    }
+	    if tag == "th" && len(t.rows) == 1 {
+		t.header = true
+	    }
+	    t.inCell = true
+	}
+    case "br":
+	if t.inCell {
+	    t.cell.WriteString(" ")
+	}
+    }
+}
+
+// endCell stores the current cell text into the last row.
+func (t *htmlTable) endCell() {
+    if !t.inCell {
+	return
+    }
+    last := len(t.rows) - 1
+    // Backticks would close the code block early.
+    cell := strings.Replace(strings.TrimSpace(t.cell.String()), "`", "'", -1)
+    t.rows[last] = append(t.rows[last], cell)
+    t.cell.Reset()
+    t.inCell = false
+}
+
+// render returns the table as a code block with aligned columns.
+func (t *htmlTable) render() string {
+    t.endCell()
+    var widths []int
+    var rows [][]string
+    for _, row := range t.rows {
+	if len(row) == 0 {
+	    continue
+	}
+	rows = append(rows, row)
+	for i, cell := range row {
+	    if i == len(widths) {
+		widths = append(widths, 0)
+	    }
+	    if n := utf8.RuneCountInString(cell); n > widths[i] {
+		widths[i] = n
+	    }
+	}
+    }
+    if len(rows) == 0 {
+	return ""
+    }
+
+    var b strings.Builder
+    b.WriteString("\n```\n")
+    for r, row := range rows {
+	line := make([]string, len(row))
+	for i, cell := range row {
+	    line[i] = cell + strings.Repeat(" ", widths[i]-utf8.RuneCountInString(cell))
+	}
+	b.WriteString(strings.TrimRight(strings.Join(line, " | "), " "))
+	b.WriteString("\n")
+	if r == 0 && t.header {
+	    sep := make([]string, len(widths))
+	    for i, w := range widths {
+		sep[i] = strings.Repeat("-", w)
+	    }
+	    b.WriteString(strings.Join(sep, "-+-"))
+	    b.WriteString("\n")
+	}
+    }
+    b.WriteString("```\n")
+    return b.String()
+}
+
+// collapseSpaces replaces runs of html whitespace with a single space.
+func collapseSpaces(s string) string {
+    var b strings.Builder
+    space := false
+    for _, r := range s {
+	if r == ' ' || r == '\t' || r == '\n' || r == '\r' || r == '\f' {
+	    space = true
+	    continue
+	}
+	if space {
+	    b.WriteByte(' ')
+	    space = false
+	}
+	b.WriteRune(r)
+    }
+    if space {
+	b.WriteByte(' ')
+    }
+    return b.String()
+}
+
+// tidyLines trims the text lines and squeezes runs of blank lines,
+// leaving code blocks as they are.
+func tidyLines(text string) string {
+    var lines []string
+    code := false
+    blank := false
+    for _, line := range strings.Split(text, "\n") {
+	if strings.HasPrefix(line, "```") {
+	    code = !code
+	} else if code {
+	    lines = append(lines, line)
+	    continue
+	}
+	line = strings.TrimSpace(line)
+	if line == "" {
+	    if blank {
+		continue
+	    }
+	    blank = true
+	} else {
+	    blank = false
+	}
+	lines = append(lines, line)
+    }
+    return strings.TrimSpace(strings.Join(lines, "\n"))
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+    "crypto/subtle"
+    "encoding/json"
+    "log"
+    "net/http"
+    "net/textproto"
+    "strings"
+    "github.com/spf13/viper"
+    "github.com/veqryn/go-email/email"
+    "github.com/ircop/smtp2tg/hooks"
+    "github.com/ircop/smtp2tg/smtpd"
+)
+
+// submission is the json payload accepted by /submit.
+type submission struct {
+    From    string `json:"from"`
+    To      string `json:"to"` // Comma separated recipients
+    Subject string `json:"subject"`
+    Body    string `json:"body"`
+}
+
+// serveHTTP runs the http endpoints on addr.
+func serveHTTP(addr string, srv *smtpd.Server) {
+    mux := http.NewServeMux()
+    // Nor let anyone post into the chats.
+    if token := viper.GetString("http.submit_token"); token != "" {
+	mux.HandleFunc("/submit", submitHandler(token, srv))
+    } else {
+	log.Printf("No http.submit_token defined, /submit is disabled")
+    }
+    // Never expose the recent mail list without credentials.
+    if password := viper.GetString("http.recent_password"); password != "" {
+	initRecent(viper.GetInt("http.recent_size"))
+	mux.HandleFunc("/recent", recentHandler(viper.GetString("http.recent_user"), password))
+    }
+    log.Printf("Initializing http server on %s...", addr)
+    if err := http.ListenAndServe(addr, mux); err != nil {
+	log.Fatal(err.Error())
+    }
+}
+
+// submitHandler returns the handler relaying json submissions as if they
+// were received by mail by srv, from clients presenting the bearer token.
+func submitHandler(token string, srv *smtpd.Server) http.HandlerFunc {
+    return func(w http.ResponseWriter, req *http.Request) {
+	auth := req.Header.Get("Authorization")
+	if( !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(token)) != 1 ) {
+	    w.Header().Set("WWW-Authenticate", `Bearer realm="smtp2tg"`)
+	    http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	    return
+	}
+	submit(w, req, srv)
+    }
+}
+
+// submit relays a json submission as if it was received by mail: in a
+// handler slot of srv, after the 202 reply, or not at all with a 503 if
+// all slots stay busy.
+func submit(w http.ResponseWriter, req *http.Request, srv *smtpd.Server) {
+    if( req.Method != http.MethodPost ) {
+	http.Error(w, "POST required", http.StatusMethodNotAllowed)
+	return
+    }
+    var sub submission
+    if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 10<<20)).Decode(&sub); err != nil {
+	http.Error(w, "Bad json: "+err.Error(), http.StatusBadRequest)
+	return
+    }
+    var to []string
+    for _, addr := range strings.Split(sub.To, ",") {
+	if addr = strings.TrimSpace(addr); addr != "" {
+	    to = append(to, addr)
+	}
+    }
+    if( len(to) == 0 || sub.Body == "" ) {
+	http.Error(w, "to and body are required", http.StatusBadRequest)
+	return
+    }
+    // They end up in headers, of the relayed mail and of notifications.
+    if( strings.ContainsAny(sub.From+sub.To+sub.Subject, "\r\n") ) {
+	http.Error(w, "from, to and subject can't contain line breaks", http.StatusBadRequest)
+	return
+    }
+
+    header := textproto.MIMEHeader{}
+    header.Set("From", sub.From)
+    header.Set("To", strings.Join(to, ", "))
+    header.Set("Subject", sub.Subject)
+    header.Set("Content-Type", "text/plain; charset=utf-8")
+    msg := &email.Message{Header: email.Header(header), Body: []byte(sub.Body)}
+    log.Printf("Received http submission from %s", req.RemoteAddr)
+    in := &inbound{Mail: hooks.Mail{From: sub.From, To: to, Msg: msg, Size: len(sub.Body)}}
+    if( !srv.Go(func() {
+	hooks.Emit(&hooks.Event{Name: hooks.Parsed, Mail: &in.Mail})
+	relay(in)
+    }) ) {
+	log.Printf("All %d handlers busy, refusing http submission from %s", srv.MaxHandlers, req.RemoteAddr)
+	http.Error(w, "Server busy, try again later", http.StatusServiceUnavailable)
+	return
+    }
+    w.WriteHeader(http.StatusAccepted)
+}
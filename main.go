@@ -2,34 +2,90 @@ package main
 
 import (
     "os"
+    "os/signal"
     "strconv"
     "strings"
     "flag"
+    "fmt"
     "bytes"
+    "bufio"
+    "io"
     "log"
     "net"
+    "net/mail"
+    "net/textproto"
+    "path"
+    "path/filepath"
+    "syscall"
+    "time"
+    "unicode/utf8"
     "gopkg.in/telegram-bot-api.v4"
     "github.com/spf13/viper"
     "github.com/veqryn/go-email/email"
+    "github.com/ircop/smtp2tg/hooks"
     "github.com/ircop/smtp2tg/smtpd"
 )
 
 var receivers map[string]string
 var bot *tgbotapi.BotAPI
 var debug bool
+var routeByHeader bool
+var attachments map[string]string
+var relayParts []string
+var fallbackChat string
+var bouncesChat string
+var deadLetterChat string
+var chatHeader string // Header naming the destination chat, disabled if empty
+var chatHeaderAllow map[string]bool // Chats chatHeader may name
+var maxUpload = 50 << 20 // Largest attachment uploaded, in bytes
+var oversizedMode = "skip" // What becomes of larger ones: skip (noted in the text) or placeholder
+var attachmentOrder = "after" // Media sent before or after the text
+var forwardRaw bool // Send mail that can't be parsed at all as an .eml document
+var portRoutes map[string]string // Listener port to the receiver its mail is routed to
+var heloRoutes map[string]string // EHLO/HELO name to the receiver its mail is routed to
 
 func main() {
 
     configFilePath := flag.String("c", "./smtp2tg.toml", "Config file location")
-    //pidFilePath := flag.String("p", "/var/run/smtp2tg.pid", "Pid file location")
+    configType := flag.String("config-type", "", "Config file format (toml, yaml, json), guessed from the file extension if empty")
+    pidFilePath := flag.String("p", "", "Pid file location, e.g. /var/run/smtp2tg.pid")
+    printConf := flag.Bool("print-config", false, "Print the effective configuration, secrets hidden, and exit")
+    showVersion := flag.Bool("version", false, "Print the version, commit and build date, and exit")
     flag.Parse()
+    if( *showVersion ) {
+	fmt.Println(versionLine())
+	return
+    }
     
     // Load & parse config
+    setDefaults()
     viper.SetConfigFile(*configFilePath)
+    if( *configType == "" ) {
+	ext := strings.TrimPrefix(filepath.Ext(*configFilePath), ".")
+	if( !supportedConfigType(ext) ) {
+	    log.Fatalf("Can't guess config format from '%s', use -config-type", *configFilePath)
+	}
+    } else {
+	if( !supportedConfigType(*configType) ) {
+	    log.Fatalf("Unsupported config type '%s'", *configType)
+	}
+	viper.SetConfigType(strings.ToLower(*configType))
+    }
     err := viper.ReadInConfig()
     if( err != nil ) {
 	log.Fatal(err.Error())
     }
+    // Let containers override listen addresses (and the token) from the environment.
+    viper.BindEnv("smtp.listen", "SMTP2TG_LISTEN")
+    viper.BindEnv("http.listen", "SMTP2TG_HTTP_LISTEN")
+    viper.BindEnv("bot.token", "SMTP2TG_TOKEN")
+    
+    if( *printConf ) {
+	if err := printConfig(os.Stdout); err != nil {
+	    log.Fatal(err.Error())
+	}
+	return
+    }
     
     // Logging
     logfile := viper.GetString("logging.file")
@@ -42,14 +98,240 @@ func main() {
 	}
 	log.SetOutput(lf)
     }
+    log.Println(versionLine())
     
     // Debug?
     debug = viper.GetBool("logging.debug")
     
+    // SMTP access log, kept apart from the application log
+    var accessLog io.Writer
+    if path := viper.GetString("logging.access_file"); path != "" {
+	af, err := os.OpenFile(path, os.O_APPEND | os.O_CREATE | os.O_WRONLY, 0666)
+	if( err != nil ) {
+	    log.Fatal(err.Error())
+	}
+	accessLog = af
+    }
+    
     
     receivers = viper.GetStringMapString("receivers")
-    if( receivers["*"] == "" ) {
-	log.Fatal("No wildcard receiver (*) found in config.")
+    fallbackChat = viper.GetString("bot.fallback_chat")
+    if( receivers["*"] == "" && fallbackChat == "" ) {
+	log.Fatal("No wildcard receiver (*) nor bot.fallback_chat found in config.")
+    }
+    if( fallbackChat != "" ) {
+	if _, err := strconv.ParseInt(fallbackChat, 10, 64); err != nil {
+	    log.Fatal("Wrong bot.fallback_chat: not int64")
+	}
+    }
+    deadLetterChat = viper.GetString("bot.dead_letter_chat")
+    if( deadLetterChat != "" ) {
+	if _, err := strconv.ParseInt(deadLetterChat, 10, 64); err != nil {
+	    log.Fatal("Wrong bot.dead_letter_chat: not int64")
+	}
+    }
+    bouncesChat = viper.GetString("bot.bounces_chat")
+    if( bouncesChat != "" ) {
+	if _, err := strconv.ParseInt(bouncesChat, 10, 64); err != nil {
+	    log.Fatal("Wrong bot.bounces_chat: not int64")
+	}
+    }
+    forwardRaw = viper.GetBool("bot.forward_raw_on_failure")
+    dedupWindow = viper.GetDuration("bot.dedup_window")
+    if mode := viper.GetString("bot.encrypted"); mode != "" {
+	if( mode != "note" && mode != "attach" ) {
+	    log.Fatalf("Wrong bot.encrypted '%s': should be note or attach", mode)
+	}
+	encryptedMode = mode
+    }
+    if order := viper.GetString("bot.attachment_order"); order != "" {
+	if( order != "before" && order != "after" ) {
+	    log.Fatalf("Wrong bot.attachment_order '%s': should be before or after", order)
+	}
+	attachmentOrder = order
+    }
+    maxUpload = viper.GetInt("bot.max_upload_mb") << 20
+    if mode := viper.GetString("bot.oversized_attachments"); mode != "" {
+	if( mode != "skip" && mode != "placeholder" ) {
+	    log.Fatalf("Wrong bot.oversized_attachments '%s': should be skip or placeholder", mode)
+	}
+	oversizedMode = mode
+    }
+    chatHeader = viper.GetString("bot.chat_header")
+    chatHeaderAllow = map[string]bool{}
+    for _, chat := range viper.GetStringSlice("bot.chat_header_allow") {
+	if _, err := strconv.ParseInt(chat, 10, 64); err != nil {
+	    log.Fatalf("Wrong bot.chat_header_allow chat '%s': not int64", chat)
+	}
+	chatHeaderAllow[chat] = true
+    }
+    if( chatHeader != "" && len(chatHeaderAllow) == 0 ) {
+	log.Fatal("bot.chat_header is set, but no bot.chat_header_allow chats defined")
+    }
+    routeByHeader = viper.GetBool("smtp.route_by_header")
+    
+    relayParts = viper.GetStringSlice("bot.relay_parts")
+    maxPartDepth = viper.GetInt("bot.max_part_depth")
+    renderTables = viper.GetBool("bot.html_tables")
+    concatTextParts = viper.GetBool("bot.concat_text_parts")
+    if prefer := viper.GetString("bot.prefer_text"); prefer != "" {
+	if( prefer != "plain" && prefer != "html" ) {
+	    log.Fatalf("Wrong bot.prefer_text '%s': should be plain or html", prefer)
+	}
+	preferText = prefer
+    }
+    includeSummary = viper.GetBool("bot.include_summary")
+    preserveNewlines = viper.GetBool("bot.preserve_newlines")
+    collapseBlanks = viper.GetBool("bot.collapse_blanks")
+    silent = viper.GetBool("bot.silent")
+    disableGoneChats = viper.GetBool("bot.disable_gone_chats")
+    disablePreview = viper.GetBool("bot.disable_preview")
+    showFrom = viper.GetBool("bot.show_from")
+    showDate = viper.GetBool("bot.show_date")
+    showTxID = viper.GetBool("bot.show_txid")
+    longBody = viper.GetString("bot.long_body")
+    if( !validLongBody(longBody) ) {
+	log.Fatalf("Wrong bot.long_body '%s': should be document, gzip, split or truncate", longBody)
+    }
+    showHeaders = viper.GetStringSlice("bot.show_headers")
+    headersMode = viper.GetString("bot.headers_mode")
+    if( headersMode != "" && headersMode != "message" && headersMode != "spoiler" && headersMode != "quote" ) {
+	log.Fatalf("Wrong bot.headers_mode '%s': should be message, spoiler or quote", headersMode)
+    }
+    limit := viper.GetString("bot.long_body_limit")
+    longBodyLimit, err = strconv.Atoi(limit)
+    if( err != nil || longBodyLimit <= 0 ) {
+	log.Fatalf("Wrong bot.long_body_limit '%s': not a positive int", limit)
+    }
+    longBodies = viper.GetStringMapString("long_body")
+    for rcpt, mode := range longBodies {
+	if( !validLongBody(mode) ) {
+	    log.Fatalf("Wrong long_body '%s' for '%s': should be document, gzip, split or truncate", mode, rcpt)
+	}
+    }
+    for rcpt, limit := range viper.GetStringMapString("long_body_limit") {
+	longBodyLimits[rcpt], err = strconv.Atoi(limit)
+	if( err != nil || longBodyLimits[rcpt] <= 0 ) {
+	    log.Fatalf("Wrong long_body_limit '%s' for '%s': not a positive int", limit, rcpt)
+	}
+    }
+    if tz := viper.GetString("bot.display_timezone"); tz != "" {
+	dateLocation, err = time.LoadLocation(tz)
+	if( err != nil ) {
+	    log.Fatalf("Wrong bot.display_timezone '%s': %s", tz, err.Error())
+	}
+    }
+    
+    var rules []rewrite
+    if err := viper.UnmarshalKey("rewrites", &rules); err != nil {
+	log.Fatalf("Wrong rewrites: %s", err.Error())
+    }
+    if err := compileRewrites(rules); err != nil {
+	log.Fatalf("Wrong rewrites: %s", err.Error())
+    }
+    if err := compileFooters(viper.GetStringMapStringSlice("footers")); err != nil {
+	log.Fatalf("Wrong footers: %s", err.Error())
+    }
+    
+    if addr := viper.GetString("mdn.relay"); addr != "" {
+	from := viper.GetString("mdn.from")
+	if( from == "" ) {
+	    log.Fatal("mdn.relay is set, but no mdn.from defined")
+	}
+	mdnReceivers = map[string]bool{}
+	for _, key := range viper.GetStringSlice("mdn.receivers") {
+	    mdnReceivers[strings.ToLower(key)] = true
+	}
+	hooks.OnDelivered(mdnSender(addr, from))
+    }
+    if host := viper.GetString("relay.host"); host != "" {
+	relayAddr = net.JoinHostPort(host, viper.GetString("relay.port"))
+	relayModes = viper.GetStringMapString("relay.receivers")
+	for rcpt, mode := range relayModes {
+	    if( mode != "also" && mode != "only" ) {
+		log.Fatalf("Wrong relay.receivers '%s' for '%s': should be also or only", mode, rcpt)
+	    }
+	}
+	hooks.OnDelivered(relayForwarder)
+    }
+    if dir := viper.GetString("archive.maildir"); dir != "" {
+	archive, err := maildirArchiver(dir)
+	if( err != nil ) {
+	    log.Fatalf("Wrong archive.maildir '%s': %s", dir, err.Error())
+	}
+	hooks.On(hooks.Received, archive)
+    }
+    if path := viper.GetString("archive.mbox"); path != "" {
+	hooks.On(hooks.Received, mboxArchiver(path))
+    }
+    if( deadLetterChat != "" ) {
+	hooks.On(hooks.Failed, func(ev *hooks.Event) {
+	    if( ev.Mail != nil ) {
+		deadLetter(ev.Mail, ev.Mail.Msg.Header.Get("Subject"), ev.Status)
+	    }
+	})
+    }
+    
+    subjectTopics = map[string]int{}
+    for tag, thread := range viper.GetStringMapString("subject_topics") {
+	subjectTopics[tag], err = strconv.Atoi(thread)
+	if( err != nil ) {
+	    log.Fatalf("Wrong subject_topics thread '%s' for '%s': not int", thread, tag)
+	}
+    }
+    
+    for rcpt, ttl := range viper.GetStringMapString("message_ttl") {
+	messageTTLs[rcpt], err = time.ParseDuration(ttl)
+	if( err != nil ) {
+	    log.Fatalf("Wrong message_ttl '%s' for '%s': %s", ttl, rcpt, err.Error())
+	}
+    }
+    for rcpt, id := range viper.GetStringMapString("reply_to") {
+	replyAnchors[rcpt], err = strconv.Atoi(id)
+	if( err != nil ) {
+	    log.Fatalf("Wrong reply_to message id '%s' for '%s': not int", id, rcpt)
+	}
+    }
+    prefixes = viper.GetStringMapString("prefix")
+    wraps = viper.GetStringMapString("wrap")
+    for rcpt, mode := range wraps {
+	if( mode != "spoiler" && mode != "quote" ) {
+	    log.Fatalf("Wrong wrap '%s' for '%s': should be spoiler or quote", mode, rcpt)
+	}
+    }
+    
+    for rcpt, window := range viper.GetStringMapString("quiet_hours") {
+	quietHours[rcpt], err = parseQuietWindow(window)
+	if( err != nil ) {
+	    log.Fatalf("Wrong quiet_hours '%s' for '%s': %s", window, rcpt, err.Error())
+	}
+    }
+    
+    for rcpt, limit := range viper.GetStringMapString("rate_limits") {
+	rateLimits[rcpt], err = parseRateLimit(limit)
+	if( err != nil ) {
+	    log.Fatalf("Wrong rate_limits '%s' for '%s': %s", limit, rcpt, err.Error())
+	}
+    }
+    
+    telegram := &telegramSender{}
+    if n := viper.GetInt("bot.max_concurrent_sends"); n > 0 {
+	telegram.slots = make(chan struct{}, n)
+    }
+    if( disableGoneChats ) {
+	telegram.enableGoneOnSignal()
+    }
+    senders["telegram"] = telegram
+    senders["slack"] = slackSender{}
+    senders["discord"] = discordSender{}
+    backends = viper.GetStringMapString("backends")
+    checkReceivers()
+    
+    attachments = viper.GetStringMapString("attachments")
+    for rcpt, policy := range attachments {
+	if( policy != "none" && policy != "images" && policy != "all" ) {
+	    log.Fatalf("Wrong attachments policy '%s' for '%s': should be none, images or all", policy, rcpt)
+	}
     }
     
     var token string = viper.GetString("bot.token")
@@ -57,98 +339,786 @@ func main() {
 	log.Fatal("No bot.token defined in config")
     }
     
-    var listen string = viper.GetString("smtp.listen")
+    // A single address, or a list of them.
+    var listen []string = viper.GetStringSlice("smtp.listen")
     var name string = viper.GetString("smtp.name")
-    if( listen == "" ) {
+    if( len(listen) == 0 ) {
 	log.Fatal("No smtp.listen defined in config.")
     }
+    if mode := viper.GetString("smtp.empty_data"); mode != "" && mode != "reject" && mode != "skip" {
+	log.Fatalf("Wrong smtp.empty_data '%s': should be reject or skip", mode)
+    }
+    for i := range listen {
+	if listen[i], err = normalizeListen(listen[i]); err != nil {
+	    log.Fatalf("Wrong smtp.listen: %s", err.Error())
+	}
+    }
     if( name == "" ) {
 	log.Fatal("No smtp.name defined in config.")
     }
+    // Banner and Received headers hostname, os.Hostname() if not set.
+    var hostname string = strings.TrimSpace(viper.GetString("smtp.hostname"))
+    if( strings.ContainsAny(hostname, " \t") ) {
+	log.Fatalf("Wrong smtp.hostname '%s': should be a single hostname", hostname)
+    }
     
     // Initialize TG bot
     bot, err = tgbotapi.NewBotAPI( token )
     if( err != nil ) {
+	notifyAlert(fmt.Sprintf("smtp2tg (%s): telegram bot failed to authenticate: %s", name, err.Error()))
 	log.Fatal(err.Error())
     }
     log.Printf("Bot authorized as %s", bot.Self.UserName )
+    telegram.setBot(bot)
+    
+    if interval := viper.GetDuration("bot.health_interval"); interval >= 0 {
+	if( interval == 0 ) {
+	    interval = 5 * time.Minute
+	}
+	failures := viper.GetInt("bot.health_failures")
+	if( failures <= 0 ) {
+	    failures = 3
+	}
+	go telegram.watch(interval, failures)
+    }
     
+    if( viper.GetBool("bot.interactive") ) {
+	loadAdmins(viper.GetStringSlice("bot.admins"))
+	if( len(admins) == 0 ) {
+	    log.Println("bot.interactive is set, but no bot.admins defined: commands will be ignored")
+	}
+	go serveCommands(telegram)
+    }
+    
+    
+    portRoutes = viper.GetStringMapString("port_routes")
+    for port, rcpt := range portRoutes {
+	if( receivers[strings.ToLower(rcpt)] == "" ) {
+	    log.Fatalf("port_routes: no receiver '%s' for port %s", rcpt, port)
+	}
+    }
+    heloRoutes = viper.GetStringMapString("helo_routes")
+    for helo, rcpt := range heloRoutes {
+	if( receivers[strings.ToLower(rcpt)] == "" ) {
+	    log.Fatalf("helo_routes: no receiver '%s' for %s", rcpt, helo)
+	}
+    }
     
-    log.Printf("Initializing smtp server on %s...", listen)
+    log.Printf("Initializing smtp server on %s...", strings.Join(listen, ", "))
     // Initialize SMTP server
-    err_ := smtpd.ListenAndServe(listen, mailHandler, "mail2tg", "", debug)
+    smtpd.SetDebug(debug)
+    srv := &smtpd.Server{
+	Handler:       mailHandler,
+	Appname:       "mail2tg",
+	Hostname:      hostname,
+	KeepAlive:     viper.GetDuration("smtp.keepalive"),
+	MaxHandlers:   viper.GetInt("smtp.max_handlers"),
+	HandlerWait:   viper.GetDuration("smtp.handler_wait"),
+	GreetPause:    viper.GetDuration("smtp.greet_pause"),
+	AccessLog:     accessLog,
+	MaxMessages:   viper.GetInt("smtp.max_messages_per_connection"),
+	NoReceived:    viper.GetBool("smtp.privacy"),
+	RequireHelo:   viper.GetBool("smtp.require_helo"),
+	RejectEmpty:   viper.GetString("smtp.empty_data") == "reject",
+	MaxConnRcpts:  viper.GetInt("smtp.max_rcpt_per_connection"),
+	MaxBadRcpts:   viper.GetInt("smtp.max_refused_rcpt"),
+	MaxCmdRate:    viper.GetInt("smtp.max_commands_per_second"),
+	EnhancedCodes: viper.GetBool("smtp.enhanced_status_codes"),
+	ProxyProtocol: viper.GetBool("smtp.proxy_protocol"),
+	AllowedHelo:   viper.GetStringSlice("smtp.allowed_helo"),
+    }
+    if token := viper.GetString("smtp.auth_token"); token != "" {
+	srv.Auth = smtpd.AuthMechanisms{"XOAUTH2": smtpd.BearerAuth(smtpd.SharedSecret(token))}
+	srv.AuthRequired = viper.GetBool("smtp.auth_required")
+    } else if( viper.GetBool("smtp.auth_required") ) {
+	log.Fatal("smtp.auth_required is set, but no smtp.auth_token defined")
+    }
+    if action := viper.GetString("smtp.check_spf"); action != "" {
+	if( action != smtpd.SPFReject && action != smtpd.SPFTag ) {
+	    log.Fatalf("Wrong smtp.check_spf '%s': should be reject or tag", action)
+	}
+	srv.SPF = map[string]string{"fail": action}
+	for _, result := range []string{"softfail", "neutral"} {
+	    a := viper.GetString("smtp.spf_" + result)
+	    if( a != "" && a != smtpd.SPFTag && a != smtpd.SPFAllow ) {
+		log.Fatalf("Wrong smtp.spf_%s '%s': should be tag or allow", result, a)
+	    }
+	    srv.SPF[result] = a
+	}
+    }
+    srv.SetMaintenance(viper.GetBool("smtp.maintenance"))
+    toggleMaintenanceOnSignal(srv)
+    if srv.TLSConfig, err = loadTLSConfig(); err != nil {
+	log.Fatal(err.Error())
+    }
+    for _, pattern := range srv.AllowedHelo {
+	if _, err := path.Match(pattern, ""); err != nil {
+	    log.Fatalf("Wrong smtp.allowed_helo pattern '%s': %s", pattern, err.Error())
+	}
+    }
+    if addr := viper.GetString("smtp.resolver"); addr != "" {
+	srv.Resolver = smtpd.NewResolver(addr)
+    }
+    // Only once the config checked out and the bot authorized: a pid file
+    // left by a failed start would look like a running instance.
+    if( *pidFilePath != "" ) {
+	if err := writePidFile(*pidFilePath); err != nil {
+	    log.Fatal(err.Error())
+	}
+	removePidFileOnExit(*pidFilePath)
+    }
+    // Submissions take handler slots of the SMTP server too.
+    if addr := viper.GetString("http.listen"); addr != "" {
+	go serveHTTP(addr, srv)
+    }
+    // All listeners share the server, and so its handler slots.
+    retries := viper.GetInt("smtp.listen_retries")
+    errs := make(chan error, len(listen))
+    for _, addr := range listen {
+	ln, err := net.Listen("tcp", addr)
+	if( err != nil ) {
+	    errs <- err
+	    break
+	}
+	go func(addr string) { errs <- serveRetrying(srv, ln, addr, retries) }(addr)
+    }
+    err_ := <-errs
     if( err_ != nil ) {
+	if( *pidFilePath != "" ) {
+	    os.Remove(*pidFilePath)
+	}
 	log.Fatal(err_.Error())
     }
 }
     
-func mailHandler(origin net.Addr, from string, to []string, data []byte) {
+// serveRetrying serves on ln. When the listener fails, it listens on addr
+// again, waiting 1s, 2s, 4s... (up to a minute) between attempts, and gives
+// up after retries failures in a row. Binding at startup isn't retried:
+// it fails for good reasons (address in use, no permission).
+func serveRetrying(srv *smtpd.Server, ln net.Listener, addr string, retries int) error {
+    failures := 0
+    backoff := time.Second
+    for {
+	started := time.Now()
+	err := srv.Serve(ln)
+	// A listener that ran for a while failed anew, not again.
+	if( time.Since(started) > time.Minute ) {
+	    failures, backoff = 0, time.Second
+	}
+	for {
+	    failures++
+	    if( failures > retries ) {
+		return fmt.Errorf("listener on %s: %s, giving up after %d retries", addr, err.Error(), retries)
+	    }
+	    logError("listener on %s: %s, listening again in %s", addr, err.Error(), backoff)
+	    time.Sleep(backoff)
+	    if( backoff < time.Minute ) {
+		backoff *= 2
+	    }
+	    if ln, err = net.Listen("tcp", addr); err == nil {
+		log.Printf("Listening on %s again", addr)
+		break
+	    }
+	}
+    }
+}
+
+func mailHandler(env *smtpd.Envelope) {
     
+    hooks.Emit(&hooks.Event{Name: hooks.Received, Env: env})
+    timing := newTimings(env.Received)
+    timing.mark("queue")
+    from, to, data := env.From, env.To, env.Data
     from = strings.Trim(from, " ")
-    to[0] = strings.Trim(to[0], " ")
-    to[0] = strings.Trim(to[0], "<")
-    to[0] = strings.Trim(to[0], ">")
-    msg, err := email.ParseMessage(bytes.NewReader(data))
-    if( err != nil ) {
-	log.Printf("[MAIL ERROR]: %s", err.Error())
+    var rcpts []string
+    for i := range to {
+	to[i] = strings.Trim(to[i], " ")
+	to[i] = strings.Trim(to[i], "<")
+	to[i] = strings.Trim(to[i], ">")
+	if( to[i] != "" ) {
+	    rcpts = append(rcpts, to[i])
+	}
+    }
+    if( len(rcpts) == 0 ) {
+	// Not a failure: there is just nowhere to deliver to.
+	log.Printf("Mail from '%s' matched no deliverable destination: no recipient left after filtering %q", from, env.To)
 	return
     }
+    to = rcpts
+    // Refuse deep nesting before the parser recurses into it.
+    err := checkPartDepth(data)
+    var msg *email.Message
+    if( err == nil ) {
+	msg, err = email.ParseMessage(bytes.NewReader(data))
+    }
+    if( err != nil ) {
+	logError("mail parse: %s", err.Error())
+	msg = lenientParse(data)
+	if( msg == nil ) {
+	    if( forwardRaw ) {
+		forwardRawMail(from, to, data)
+	    }
+	    hooks.Emit(&hooks.Event{Name: hooks.Failed, Env: env, Status: "failed: " + err.Error()})
+	    return
+	}
+	log.Printf("Relaying mail from '%s' in lenient mode", from)
+    }
+    timing.mark("parse")
+    in := &inbound{Mail: hooks.Mail{From: from, To: to, Msg: msg, Size: len(data), SPF: env.SPF, Helo: env.Helo, ID: env.ID, Env: env}, Timings: timing}
+    if env.LocalAddr != nil {
+	_, in.Port, _ = net.SplitHostPort(env.LocalAddr.String())
+    }
+    hooks.Emit(&hooks.Event{Name: hooks.Parsed, Env: env, Mail: &in.Mail})
+    relay(in)
+}
+
+// inbound is a parsed mail to relay, whatever way it was received.
+type inbound struct {
+    hooks.Mail
+    Timings *timings // Stage durations, from the reception
+}
+
+// relay routes the mail and delivers its text and attachments.
+func relay(in *inbound) {
+    msg := in.Msg
+    if subject := msg.Header.Get("Subject"); subject != "" && len(rewrites) > 0 {
+	msg.Header["Subject"] = []string{rewriteSubject(subject)}
+    }
     subject := msg.Header.Get("Subject")
-    log.Printf("Received mail from '%s' for '%s' with subject '%s'", from, to[0], subject)
+    log.Printf("Received mail%s from '%s' for '%s' with subject '%s'", idTag(in), in.From, strings.Join(in.To, ", "), subject)
+    status := "delivered"
+    var r *route
+    if( in.Timings == nil ) {
+	in.Timings = newTimings(time.Now())
+    }
+    timing := in.Timings
+    defer func() {
+	logTimings(timing)
+	recordRecent(in, subject, status)
+	var hr *hooks.Route
+	if( r != nil ) {
+	    hr = &r.Route
+	}
+	if( status == "delivered" ) {
+	    rememberDelivered(msg.Header.Get("Message-ID"), r)
+	    hooks.Emit(&hooks.Event{Name: hooks.Delivered, Env: in.Env, Mail: &in.Mail, Route: hr, Status: status})
+	} else if( strings.HasPrefix(status, "failed") ) {
+	    hooks.Emit(&hooks.Event{Name: hooks.Failed, Env: in.Env, Mail: &in.Mail, Route: hr, Status: status})
+	}
+    }()
     
     // Find receivers and send to TG
-    var tgid string
-    if( receivers[to[0]] != "" ) {
-	tgid = receivers[to[0]]
-    } else {
-	tgid = receivers["*"]
+    rcpts := in.To
+    if( routeByHeader ) {
+	rcpts = headerRecipients(msg)
+	if len(rcpts) == 0 {
+	    log.Printf("No To/Cc addresses in headers, routing by envelope recipient")
+	    rcpts = in.To
+	}
+    }
+    rcptKey, dest := findReceiver(rcpts)
+    if rcpt := heloRoutes[strings.ToLower(in.Helo)]; rcpt != "" && (rcptKey == "*" || rcptKey == "fallback") {
+	// No receiver of its own: route by the client identity instead.
+	rcptKey, dest = findReceiver([]string{rcpt})
+    }
+    if rcpt := portRoutes[in.Port]; rcpt != "" && (rcptKey == "*" || rcptKey == "fallback") {
+	// No receiver of its own: route by the listener instead.
+	rcptKey, dest = findReceiver([]string{rcpt})
+    }
+    if chat := headerChat(msg); chat != "" {
+	log.Printf("Mail names chat %s in %s, relaying there", chat, chatHeader)
+	rcptKey, dest = "chat_header", chat
+    }
+    if( bouncesChat != "" && isBounce(in) ) {
+	log.Printf("Mail is a delivery status notification, relaying to the bounces chat")
+	rcptKey, dest = "bounces", bouncesChat
+    }
+    if( dest == "" ) {
+	log.Printf("Mail from '%s' for %v matched no deliverable destination: receiver '%s' has none", in.From, rcpts, rcptKey)
+	status = "skipped: no destination"
+	return
+    }
+    r, err := newRoute(rcptKey, dest)
+    if( err != nil ) {
+	logError("%s", err.Error())
+	status = "failed: " + err.Error()
+	return
+    }
+    if id := msg.Header.Get("Message-ID"); duplicate(id, r) {
+	log.Printf("Mail %s was delivered to '%s' already, skipping the duplicate", id, r.Key)
+	status = "skipped: duplicate"
+	return
     }
+    // Forwarded instead of relayed to the chat. Mail submitted over http
+    // has no raw mail to forward, it goes to the chat as usual.
+    if( relayMode(r.Key) == "only" && in.Env == nil ) {
+	log.Printf("Mail for '%s' wasn't received by SMTP, relaying it to the chat instead of forwarding", r.Key)
+    } else if( relayMode(r.Key) == "only" ) {
+	if err := forwardToRelay(&in.Mail); err != nil {
+	    logError("relay forward to %s: %s", relayAddr, err.Error())
+	    status = "failed: " + err.Error()
+	}
+	return
+    }
+    r.Thread = subjectTopic(subject)
+    policy := attachmentPolicy(r.Key)
     
-    textMsgs := msg.MessagesContentTypePrefix("text")
-    images := msg.MessagesContentTypePrefix("image")
-    if len(textMsgs) == 0 && len(images) == 0 {
-        log.Printf("mail doesn't contain text or image")
-	    return    
+    var textMsgs, images, files []*email.Message
+    if( wantPart("text") ) {
+	textMsgs = bodyParts(msg)
+    }
+    if( policy != "none" && wantPart("image") ) {
+	images = partsWithPrefix(msg, "image")
+    }
+    if( policy == "all" ) {
+	files = otherAttachments(msg)
+    }
+    // Telegram would refuse them, failing the whole mail.
+    var oversized []*email.Message
+    images = withinUploadLimit(images, &oversized)
+    files = withinUploadLimit(files, &oversized)
+    if len(textMsgs) == 0 && len(images) == 0 && len(files) == 0 && len(oversized) == 0 {
+	log.Printf("mail doesn't contain text or attachments allowed for '%s'", r.Key)
+	status = "skipped: nothing to relay"
+	return
     }
 
-    log.Printf("Relaying message to: %v", tgid)
+    log.Printf("Relaying message to: %v (%s)", r.Dest, r.Backend)
     
-    i, err := strconv.ParseInt(tgid, 10, 64)
+    var body string
+    if( len(textMsgs) > 0 && concatTextParts ) {
+	body = plainTextBody(textMsgs)
+    }
+    if( len(textMsgs) > 0 && body == "" ) {
+	part := bestTextPart(textMsgs)
+	body = string(part.Body)
+	if( partType(part) == "text/html" ) {
+	    body = htmlToText(body)
+	}
+    }
+    body = trimFooter(r.Key, rewriteBody(body))
+    if( strings.TrimSpace(body) == "" && len(images) == 0 && len(files) == 0 && len(oversized) == 0 ) {
+	log.Printf("Mail from '%s' has an empty body and no attachments, skipping", in.From)
+	status = "skipped: empty message"
+	return
+    }
+    // Oversized attachments are noted at the end of the text, if any.
+    noteInText := oversizedMode == "skip" && strings.TrimSpace(body) != ""
+    // sendMedia sends the images, the other attachments and the notes of
+    // oversized ones, returning the error that stopped it.
+    sendMedia := func() error {
+	// TODO Better to use 'sendMediaGroup' to send all attachments as a
+	// single message, but go telegram api has not implemented it yet
+	// https://github.com/go-telegram-bot-api/telegram-bot-api/issues/143
+	for _, part := range images {
+	    _, params, err := part.Header.ContentDisposition()
+	    if err != nil {
+		logError("content disposition parse: '%s'", err.Error())
+		return err
+	    }
+	    waitRate(r.Key)
+	    err = r.Sender.SendPhoto(r, params["filename"], part.Body)
+	    timing.mark("send_photo")
+	    if err != nil {
+		logError("%s photo send: '%s'", r.Backend, err.Error())
+		return err
+	    }
+	}
+
+	for _, part := range files {
+	    waitRate(r.Key)
+	    err = r.Sender.SendDocument(r, partFilename(part), part.Body)
+	    timing.mark("send_document")
+	    if err != nil {
+		logError("%s document send: '%s'", r.Backend, err.Error())
+		return err
+	    }
+	}
+
+	// Placeholders in place of the uploads, or the note of skipped ones
+	// when there was no text to add it to.
+	var notes []string
+	if( oversizedMode == "placeholder" ) {
+	    for _, part := range oversized {
+		notes = append(notes, oversizedNote([]*email.Message{part}))
+	    }
+	} else if( !noteInText && len(oversized) > 0 ) {
+	    notes = append(notes, oversizedNote(oversized))
+	}
+	for _, note := range notes {
+	    waitRate(r.Key)
+	    err = r.Sender.SendText(r, note)
+	    timing.mark("send_text")
+	    if err != nil {
+		logError("%s message send: '%s'", r.Backend, err.Error())
+		return err
+	    }
+	}
+	return nil
+    }
+    if( attachmentOrder == "before" ) {
+	// Media lead, the text follows: no captioned photo.
+	if err := sendMedia(); err != nil {
+	    status = "failed: " + err.Error()
+	    return
+	}
+	images, files = nil, nil
+    }
+
+    // Some senders (camera alerts) attach an empty text part next to the
+    // images, don't relay it as a blank message.
+    if strings.TrimSpace(body) != "" {
+	text := formatBody(in, body)
+	mode, limit := longBodyMode(r.Key), longBodyMax(r.Key)
+	long := (mode == "document" || mode == "gzip") && len(text) > limit
+	if( long ) {
+	    text = longBodySummary(in, body, longBodyName(mode))
+	}
+	if( noteInText && len(oversized) > 0 ) {
+	    text += "\n\n" + oversizedNote(oversized)
+	}
+	text = withPrefix(r.Key, text)
+	// Text following the first message when split.
+	var rest []string
+	if( mode == "truncate" ) {
+	    text = truncateText(text, limit)
+	} else if( mode == "split" && len(text) > limit ) {
+	    chunks := splitText(text, limit)
+	    text, rest = chunks[0], chunks[1:]
+	}
+	waitRate(r.Key)
+	if captioner, ok := r.Sender.(photoCaptioner); ok && !long && len(rest) == 0 && len(images) == 1 && len(files) == 0 && fitsCaption(r, text) {
+	    // A single image with a short text reads better as one message.
+	    err = captioner.SendPhotoCaption(r, partFilename(images[0]), text, images[0].Body)
+	    timing.mark("send_photo")
+	    images = nil
+	} else {
+	    err = r.Sender.SendText(r, text)
+	    timing.mark("send_text")
+	}
+	if err != nil {
+	    logError("%s message send: '%s'", r.Backend, err.Error())
+	    status = "failed: " + err.Error()
+	    return
+	}
+	for _, chunk := range rest {
+	    waitRate(r.Key)
+	    err = r.Sender.SendText(r, chunk)
+	    timing.mark("send_text")
+	    if err != nil {
+		logError("%s message send: '%s'", r.Backend, err.Error())
+		status = "failed: " + err.Error()
+		return
+	    }
+	}
+	if( long ) {
+	    waitRate(r.Key)
+	    data := []byte(body)
+	    if( mode == "gzip" ) {
+		data = gzipText(data)
+	    }
+	    err = r.Sender.SendDocument(r, longBodyName(mode), data)
+	    timing.mark("send_document")
+	    if err != nil {
+		logError("%s document send: '%s'", r.Backend, err.Error())
+		status = "failed: " + err.Error()
+		return
+	    }
+	}
+    }
+
+    if( len(showHeaders) > 0 ) {
+	if headers := headerBlock(msg); headers != "" {
+	    hr := *r
+	    if( headersMode == "spoiler" || headersMode == "quote" ) {
+		// Collapsed out of the way, shown on demand.
+		hr.Wrap = headersMode
+	    } else {
+		headers = codeBlock(headers)
+	    }
+	    waitRate(r.Key)
+	    err = r.Sender.SendText(&hr, headers)
+	    timing.mark("send_headers")
+	    if err != nil {
+		logError("%s headers send: '%s'", r.Backend, err.Error())
+	    }
+	}
+    }
+
+    if( attachmentOrder != "before" ) {
+	if err := sendMedia(); err != nil {
+	    status = "failed: " + err.Error()
+	    return
+	}
+    }
+}
+
+// withinUploadLimit returns the parts small enough to upload, adding the
+// others to oversized.
+func withinUploadLimit(parts []*email.Message, oversized *[]*email.Message) []*email.Message {
+    var kept []*email.Message
+    for _, part := range parts {
+	if( len(part.Body) > maxUpload ) {
+	    log.Printf("Attachment '%s' (%s) is over the upload limit, not uploading it", partFilename(part), humanSize(len(part.Body)))
+	    *oversized = append(*oversized, part)
+	    continue
+	}
+	kept = append(kept, part)
+    }
+    return kept
+}
+
+// oversizedNote tells about attachments too large to upload, a line each.
+func oversizedNote(parts []*email.Message) string {
+    var lines []string
+    for _, part := range parts {
+	lines = append(lines, fmt.Sprintf("📎 %s (%s): over the %s upload limit, not attached", partFilename(part), humanSize(len(part.Body)), humanSize(maxUpload)))
+    }
+    return strings.Join(lines, "\n")
+}
+
+// attachmentPolicy returns which attachments are relayed to the receiver:
+// "none", "images" (the default) or "all".
+func attachmentPolicy(rcptKey string) string {
+    policy := attachments[rcptKey]
+    if( policy == "" ) {
+	policy = attachments["*"]
+    }
+    if( policy == "" ) {
+	policy = "images"
+    }
+    return policy
+}
+
+// otherAttachments returns the leaf parts of the message which are neither
+// images nor text body candidates: text attachments are included.
+func otherAttachments(msg *email.Message) []*email.Message {
+    var parts []*email.Message
+    for _, part := range leafParts(msg) {
+	ctype := partType(part)
+	if( strings.HasPrefix(ctype, "image") || (strings.HasPrefix(ctype, "text") && !textAttachment(part)) || !wantPart(ctype) ) {
+	    continue
+	}
+	parts = append(parts, part)
+    }
+    return parts
+}
+
+// wantPart reports whether parts of the content type are relayed,
+// according to the bot.relay_parts prefixes. All are if none configured.
+// The whole mail is parsed regardless, this only filters what is relayed.
+func wantPart(ctype string) bool {
+    if( len(relayParts) == 0 ) {
+	return true
+    }
+    for _, prefix := range relayParts {
+	if( strings.HasPrefix(ctype, strings.ToLower(prefix)) ) {
+	    return true
+	}
+    }
+    return false
+}
+
+// partFilename returns the file name of an attachment part.
+func partFilename(part *email.Message) string {
+    if _, params, err := part.Header.ContentDisposition(); err == nil && params["filename"] != "" {
+	return params["filename"]
+    }
+    if _, params, err := part.Header.ContentType(); err == nil && params["name"] != "" {
+	return params["name"]
+    }
+    return "attachment"
+}
+
+// supportedConfigType reports whether viper can read configs of type t.
+func supportedConfigType(t string) bool {
+    for _, ext := range viper.SupportedExts {
+	if( ext == strings.ToLower(t) ) {
+	    return true
+	}
+    }
+    return false
+}
+
+// fitsCaption reports whether the text can be sent as a photo caption:
+// short enough, and not relying on markup (captions are sent as plain text).
+func fitsCaption(r *route, text string) bool {
+    return utf8.RuneCountInString(text) <= captionLimit && !preserveNewlines && textWrap(r.Key) == "" && r.Wrap == ""
+}
+
+// normalizeListen turns a listen address into host:port form, accepting a
+// bare port ("25"), and reports mistakes before trying to bind.
+func normalizeListen(addr string) (string, error) {
+    addr = strings.TrimSpace(addr)
+    if _, err := strconv.Atoi(addr); err == nil {
+	addr = ":" + addr
+    }
+    host, port, err := net.SplitHostPort(addr)
+    if( err != nil ) {
+	return "", fmt.Errorf("'%s' should be port, :port or host:port", addr)
+    }
+    if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+	return "", fmt.Errorf("'%s': port should be a number from 1 to 65535", addr)
+    }
+    if( host != "" && net.ParseIP(host) == nil && strings.ContainsAny(host, " \t/[]") ) {
+	return "", fmt.Errorf("'%s': '%s' is neither an ip address nor a hostname", addr, host)
+    }
+    return net.JoinHostPort(host, port), nil
+}
+
+// logError logs an error and records it as the last one in the server stats.
+func logError(format string, args ...interface{}) {
+    msg := fmt.Sprintf(format, args...)
+    log.Printf("[ERROR]: %s", msg)
+    smtpd.SetLastError(msg)
+}
+
+// lenientParse splits a message the strict parser refused into headers and
+// body at the first blank line, relaying the raw body as plain text.
+// Returns nil if there is no body at all.
+func lenientParse(data []byte) *email.Message {
+    var head, body []byte
+    if idx := bytes.Index(data, []byte("\r\n\r\n")); idx != -1 {
+	head, body = data[:idx+2], data[idx+4:]
+    } else if idx := bytes.Index(data, []byte("\n\n")); idx != -1 {
+	head, body = data[:idx+1], data[idx+2:]
+    } else {
+	body = data
+    }
+    if( len(bytes.TrimSpace(body)) == 0 ) {
+	return nil
+    }
+    header, err := textproto.NewReader(bufio.NewReader(io.MultiReader(bytes.NewReader(head), strings.NewReader("\r\n")))).ReadMIMEHeader()
+    if( err != nil ) {
+	// Keep whatever was read, a broken header shouldn't lose the body.
+	log.Printf("Lenient mode: header parse: %s", err.Error())
+    }
+    if( header == nil ) {
+	header = textproto.MIMEHeader{}
+    }
+    header.Set("Content-Type", "text/plain")
+    header.Del("Content-Transfer-Encoding")
+    return &email.Message{Header: email.Header(header), Body: body}
+}
+
+// headerChat returns the chat the mail names in the chatHeader header,
+// if it is allowed, or an empty string.
+func headerChat(msg *email.Message) string {
+    if( chatHeader == "" ) {
+	return ""
+    }
+    chat := strings.TrimSpace(msg.Header.Get(chatHeader))
+    if( chat == "" ) {
+	return ""
+    }
+    if( !chatHeaderAllow[chat] ) {
+	log.Printf("Mail names chat '%s' in %s, which is not allowed, routing by recipient", chat, chatHeader)
+	return ""
+    }
+    return chat
+}
+
+// forwardRawMail sends the original mail as an .eml document to the chat
+// it is routed to, when nothing could be made of it: the operator still
+// gets to see it.
+func forwardRawMail(from string, to []string, data []byte) {
+    rcptKey, dest := findReceiver(to)
+    if( dest == "" ) {
+	log.Printf("Mail from '%s' for %v matched no deliverable destination: receiver '%s' has none", from, to, rcptKey)
+	return
+    }
+    r, err := newRoute(rcptKey, dest)
     if( err != nil ) {
-	log.Printf("[ERROR]: wrong telegram id: not int64")
+	logError("%s", err.Error())
 	return
     }
-    
-    if len(textMsgs) > 0 {
-        bodyStr := string(textMsgs[0].Body)
-        tgMsg := tgbotapi.NewMessage(i, bodyStr)
-        tgMsg.ParseMode = tgbotapi.ModeMarkdown
-        _, err = bot.Send(tgMsg)
-        if err != nil {
-            log.Printf("[ERROR]: telegram message send: '%s'", err.Error())
-            return
-        }
-    }
-
-    // TODO Better to use 'sendMediaGroup' to send all attachments as a
-    // single message, but go telegram api has not implemented it yet
-    // https://github.com/go-telegram-bot-api/telegram-bot-api/issues/143    
-    for _, part := range msg.MessagesContentTypePrefix("image") {
-        _, params, err := part.Header.ContentDisposition()
-        if err != nil {
-            log.Printf("[ERROR]: content disposition parse: '%s'", err.Error())
-            return
-        }
-        text := params["filename"]
-        tgFile := tgbotapi.FileBytes{Name: text, Bytes: part.Body}
-        tgMsg := tgbotapi.NewPhotoUpload(i, tgFile)
-        tgMsg.Caption = text
-        // It's not a separate message, so disable notification
-        tgMsg.DisableNotification = true
-        _, err = bot.Send(tgMsg)
-        if err != nil {
-            log.Printf("[ERROR]: telegram photo send: '%s'", err.Error())
-            return
-        }
+    log.Printf("Forwarding unparsable mail from '%s' to %v (%s) as a file", from, r.Dest, r.Backend)
+    waitRate(r.Key)
+    if err := r.Sender.SendDocument(r, "message.eml", data); err != nil {
+	logError("%s raw mail send: '%s'", r.Backend, err.Error())
+    }
+}
+
+// findReceiver returns the receiver key and destination configured for the
+// first address having its own receiver, or the wildcard ones. Mail matching
+// neither goes to bot.fallback_chat, under the "fallback" key.
+func findReceiver(addrs []string) (string, string) {
+    for _, addr := range addrs {
+	// viper lowercases map keys, so compare lowercased.
+	key := strings.ToLower(addr)
+	if dest := receivers[key]; dest != "" {
+	    return key, dest
+	}
+    }
+    if( receivers["*"] != "" ) {
+	return "*", receivers["*"]
+    }
+    log.Printf("No receiver matched %v, relaying to the fallback chat", addrs)
+    return "fallback", fallbackChat
+}
+
+// deadLetter posts a summary of a mail that couldn't be delivered to
+// bot.dead_letter_chat, so it isn't dropped unnoticed.
+func deadLetter(in *hooks.Mail, subject string, status string) {
+    if( deadLetterChat == "" ) {
+	return
+    }
+    r, err := newRoute("dead_letter", deadLetterChat)
+    if( err != nil ) {
+	logError("dead letter: %s", err.Error())
+	return
+    }
+    text := fmt.Sprintf("Undelivered mail\nFrom: %s\nTo: %s\nSubject: %s\nError: %s",
+	in.From, strings.Join(in.To, ", "), subject, strings.TrimPrefix(status, "failed: "))
+    if err := r.Sender.SendText(r, codeBlock(text)); err != nil {
+	logError("dead letter send: %s", err.Error())
     }
 }
+
+// isBounce reports whether the mail is a delivery status notification:
+// received over SMTP with a null sender, or a multipart/report (RFC 6522).
+// Mail submitted over http may have no sender at all, that's no bounce.
+func isBounce(in *inbound) bool {
+    if( in.Env != nil && (in.From == "" || in.From == "<>") ) {
+	return true
+    }
+    ctype, _, err := in.Msg.Header.ContentType()
+    return err == nil && strings.ToLower(ctype) == "multipart/report"
+}
+
+// headerRecipients returns the addresses from the To: and Cc: headers of the message.
+func headerRecipients(msg *email.Message) []string {
+    var addrs []string
+    for _, key := range []string{"To", "Cc"} {
+	value := msg.Header.Get(key)
+	if value == "" {
+	    continue
+	}
+	list, err := mail.ParseAddressList(value)
+	if err != nil {
+	    logError("can't parse %s header '%s': %s", key, value, err.Error())
+	    continue
+	}
+	for _, a := range list {
+	    addrs = append(addrs, a.Address)
+	}
+    }
+    return addrs
+}
+
+// toggleMaintenanceOnSignal switches the server maintenance mode on
+// every SIGUSR1.
+func toggleMaintenanceOnSignal(srv *smtpd.Server) {
+    sig := make(chan os.Signal, 1)
+    signal.Notify(sig, syscall.SIGUSR1)
+    go func() {
+	for range sig {
+	    srv.SetMaintenance(!srv.Maintenance())
+	    if( srv.Maintenance() ) {
+		log.Printf("Maintenance mode on, refusing mail")
+	    } else {
+		log.Printf("Maintenance mode off")
+	    }
+	}
+    }()
+}
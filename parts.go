@@ -0,0 +1,210 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "fmt"
+    "log"
+    "regexp"
+    "strings"
+    "github.com/veqryn/go-email/email"
+)
+
+// maxPartDepth limits how deep multipart structures may nest. Mail nested
+// deeper isn't MIME-parsed at all (see checkPartDepth).
+var maxPartDepth = 10
+
+// boundaryRE finds the boundary parameter of multipart content types.
+var boundaryRE = regexp.MustCompile(`(?i)\bboundary\s*=\s*(?:"([^"]+)"|([^\s;]+))`)
+
+// encryptedMode says what becomes of encrypted parts (PGP/MIME, S/MIME):
+// "note" relays a note in place of their undisplayable content, "attach"
+// relays them as they are, as files.
+var encryptedMode = "note"
+
+// encryptedNote is the text relayed in place of an encrypted part.
+const encryptedNote = "🔒 Encrypted message, cannot display"
+
+// checkPartDepth scans the raw mail for multipart boundaries, before the
+// parser recurses into them, and returns an error if they nest deeper than
+// maxPartDepth. Boundaries declared outside headers can only make the
+// count higher, never hide nesting.
+func checkPartDepth(data []byte) error {
+    var open []string // Delimiters of the enclosing multiparts, outermost first
+    scanner := bufio.NewScanner(bytes.NewReader(data))
+    scanner.Buffer(nil, len(data)+1)
+    for scanner.Scan() {
+	line := bytes.TrimRight(scanner.Bytes(), " \t\r")
+	if bytes.HasPrefix(line, []byte("--")) {
+	    // A delimiter closes the parts nested in the previous part of
+	    // its multipart, a close delimiter the multipart itself.
+	    for i := len(open) - 1; i >= 0; i-- {
+		if( string(line) == open[i] ) {
+		    open = open[:i+1]
+		    break
+		}
+		if( len(line) == len(open[i])+2 && bytes.HasPrefix(line, []byte(open[i])) && bytes.HasSuffix(line, []byte("--")) ) {
+		    open = open[:i]
+		    break
+		}
+	    }
+	    continue
+	}
+	// Most lines have none (a parameter has a '='), spare them the regexp.
+	if( bytes.IndexByte(line, '=') < 0 || !bytes.Contains(bytes.ToLower(line), []byte("boundary")) ) {
+	    continue
+	}
+	for _, m := range boundaryRE.FindAllSubmatch(line, -1) {
+	    open = append(open, "--"+string(m[1])+string(m[2]))
+	    if( len(open) > maxPartDepth ) {
+		return fmt.Errorf("multiparts nested deeper than %d levels", maxPartDepth)
+	    }
+	}
+    }
+    return nil
+}
+
+// leafParts returns the parts of msg carrying a body, not descending more
+// than maxPartDepth levels of nested multiparts or attached messages.
+func leafParts(msg *email.Message) []*email.Message {
+    var parts []*email.Message
+    var walk func(m *email.Message, depth int)
+    walk = func(m *email.Message, depth int) {
+	switch {
+	case partType(m) == "multipart/signed" && len(m.Parts) > 0:
+	    // The content signed is the first part, the signature the
+	    // second one: relay the content only.
+	    walk(m.Parts[0], depth+1)
+	    return
+	case encryptedMode == "note" && encryptedPart(m):
+	    parts = append(parts, &email.Message{
+		Header: email.Header{"Content-Type": []string{"text/plain; charset=utf-8"}},
+		Body:   []byte(encryptedNote),
+	    })
+	    return
+	}
+	if len(m.Parts) == 0 && m.SubMessage == nil {
+	    parts = append(parts, m)
+	    return
+	}
+	if( depth >= maxPartDepth ) {
+	    log.Printf("Parts nested deeper than %d levels, skipping them", maxPartDepth)
+	    return
+	}
+	for _, p := range m.Parts {
+	    walk(p, depth+1)
+	}
+	if m.SubMessage != nil {
+	    walk(m.SubMessage, depth+1)
+	}
+    }
+    walk(msg, 0)
+    return parts
+}
+
+// encryptedPart reports whether the part is an encrypted PGP/MIME
+// multipart or S/MIME body.
+func encryptedPart(part *email.Message) bool {
+    ctype, params, err := part.Header.ContentType()
+    if( err != nil ) {
+	return false
+    }
+    switch strings.ToLower(ctype) {
+    case "multipart/encrypted":
+	return true
+    case "application/pkcs7-mime", "application/x-pkcs7-mime":
+	// Opaque signed-data is signed, not encrypted.
+	return strings.ToLower(params["smime-type"]) != "signed-data"
+    }
+    return false
+}
+
+// partType returns the media type of the part, text/plain if not set
+// as RFC 2045 specifies.
+func partType(part *email.Message) string {
+    ctype, _, err := part.Header.ContentType()
+    if( err != nil || ctype == "" ) {
+	return "text/plain"
+    }
+    return strings.ToLower(ctype)
+}
+
+// preferText is the alternative relayed when a mail has both a text/plain
+// and a text/html body: "plain" or "html".
+var preferText = "plain"
+
+// bestTextPart picks the body to relay among the text parts: the first of
+// the preferred type, else the first of the other one, else the first part.
+// Alternatives of multipart/alternative are never relayed both.
+func bestTextPart(parts []*email.Message) *email.Message {
+    other := "text/html"
+    if( preferText == "html" ) {
+	other = "text/plain"
+    }
+    var fallback *email.Message
+    for _, part := range parts {
+	switch partType(part) {
+	case "text/" + preferText:
+	    return part
+	case other:
+	    if fallback == nil {
+		fallback = part
+	    }
+	}
+    }
+    if fallback != nil {
+	return fallback
+    }
+    return parts[0]
+}
+
+// concatTextParts makes the body the text/plain parts joined, rather
+// than the best text part only.
+var concatTextParts bool
+
+// textPartSeparator separates the joined text/plain parts.
+const textPartSeparator = "\n\n---\n\n"
+
+// plainTextBody joins the inline text/plain parts, empty if there are none.
+func plainTextBody(parts []*email.Message) string {
+    var texts []string
+    for _, part := range parts {
+	if partType(part) != "text/plain" || textAttachment(part) {
+	    continue
+	}
+	if text := strings.TrimSpace(string(part.Body)); text != "" {
+	    texts = append(texts, text)
+	}
+    }
+    return strings.Join(texts, textPartSeparator)
+}
+
+// textAttachment reports whether the part is a text attachment (a CSV
+// report, a log), relayed as a file rather than as the body.
+func textAttachment(part *email.Message) bool {
+    disposition, _, _ := part.Header.ContentDisposition()
+    return strings.HasPrefix(partType(part), "text") && strings.ToLower(disposition) == "attachment"
+}
+
+// bodyParts returns the text parts of msg the body is picked from, text
+// attachments left out.
+func bodyParts(msg *email.Message) []*email.Message {
+    var parts []*email.Message
+    for _, part := range partsWithPrefix(msg, "text") {
+	if( !textAttachment(part) ) {
+	    parts = append(parts, part)
+	}
+    }
+    return parts
+}
+
+// partsWithPrefix returns the leaf parts whose media type starts with prefix.
+func partsWithPrefix(msg *email.Message, prefix string) []*email.Message {
+    var parts []*email.Message
+    for _, part := range leafParts(msg) {
+	if strings.HasPrefix(partType(part), prefix) {
+	    parts = append(parts, part)
+	}
+    }
+    return parts
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+    "testing"
+    "github.com/veqryn/go-email/email"
+)
+
+// nestedMail is a mail with depth multiparts nested in each other.
+func nestedMail(depth int) string {
+    var b strings.Builder
+    for i := 0; i < depth; i++ {
+	fmt.Fprintf(&b, "Content-Type: multipart/mixed; boundary=\"b%d\"\r\n\r\n--b%d\r\n", i, i)
+    }
+    b.WriteString("Content-Type: text/plain\r\n\r\nhello\r\n")
+    for i := depth - 1; i >= 0; i-- {
+	fmt.Fprintf(&b, "--b%d--\r\n", i)
+    }
+    return b.String()
+}
+
+func TestCheckPartDepth(t *testing.T) {
+    if err := checkPartDepth([]byte(nestedMail(maxPartDepth))); err != nil {
+	t.Errorf("%d levels: %s", maxPartDepth, err)
+    }
+    if err := checkPartDepth([]byte(nestedMail(maxPartDepth + 1))); err == nil {
+	t.Errorf("%d levels: no error", maxPartDepth+1)
+    }
+
+    // Sibling multiparts, each closed before the next one, don't add up.
+    var b strings.Builder
+    b.WriteString("Content-Type: multipart/mixed; boundary=top\r\n\r\n")
+    for i := 0; i < 3*maxPartDepth; i++ {
+	fmt.Fprintf(&b, "--top\r\nContent-Type: multipart/alternative; BOUNDARY=a%d\r\n\r\n--a%d\r\nContent-Type: text/plain\r\n\r\nx\r\n--a%d--\r\n", i, i, i)
+    }
+    b.WriteString("--top--\r\n")
+    if err := checkPartDepth([]byte(b.String())); err != nil {
+	t.Errorf("siblings: %s", err)
+    }
+}
+
+// A text attachment next to the body is a file, not a body candidate.
+func TestTextAttachments(t *testing.T) {
+    body := &email.Message{Header: email.Header{"Content-Type": {"text/html"}}, Body: []byte("<p>report</p>")}
+    csv := &email.Message{Header: email.Header{
+	"Content-Type":        {"text/csv"},
+	"Content-Disposition": {"attachment; filename=\"report.csv\""},
+    }, Body: []byte("a,b\n1,2\n")}
+    pdf := &email.Message{Header: email.Header{"Content-Type": {"application/pdf"}}, Body: []byte("%PDF")}
+    msg := &email.Message{Header: email.Header{"Content-Type": {"multipart/mixed; boundary=x"}}, Parts: []*email.Message{body, csv, pdf}}
+
+    if parts := bodyParts(msg); len(parts) != 1 || parts[0] != body {
+	t.Errorf("body parts %v, want the html one only", parts)
+    }
+    files := otherAttachments(msg)
+    if len(files) != 2 || files[0] != csv || files[1] != pdf {
+	t.Errorf("attachments %v, want the csv and the pdf", files)
+    }
+}
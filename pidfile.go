@@ -0,0 +1,46 @@
+package main
+
+import (
+    "fmt"
+    "io/ioutil"
+    "log"
+    "os"
+    "os/signal"
+    "strconv"
+    "strings"
+    "syscall"
+)
+
+// writePidFile writes the pid of the process to path, unless a live
+// process already owns the file.
+func writePidFile(path string) error {
+    if data, err := ioutil.ReadFile(path); err == nil {
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err == nil && pid > 0 && processAlive(pid) {
+	    return fmt.Errorf("pid file %s is owned by running process %d", path, pid)
+	}
+    }
+    return ioutil.WriteFile(path, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644)
+}
+
+// processAlive reports whether a process with the pid exists.
+func processAlive(pid int) bool {
+    p, err := os.FindProcess(pid)
+    if err != nil {
+	return false
+    }
+    err = p.Signal(syscall.Signal(0))
+    return err == nil || err == syscall.EPERM
+}
+
+// removePidFileOnExit removes the pid file when the process is asked to stop.
+func removePidFileOnExit(path string) {
+    sig := make(chan os.Signal, 1)
+    signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+    go func() {
+	s := <-sig
+	log.Printf("Received %s, shutting down", s)
+	os.Remove(path)
+	os.Exit(0)
+    }()
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+    "encoding/json"
+    "io"
+    "strings"
+    "github.com/spf13/viper"
+)
+
+// configDefaults are the values used for options left out of the config,
+// by their dotted key. setDefaults registers them with viper, so the
+// options are read and shown by -print-config with them.
+var configDefaults = map[string]interface{}{
+    "bot.max_part_depth":        10,
+    "bot.prefer_text":           "plain",
+    "bot.long_body_limit":       4096,
+    "bot.health_interval":       "5m",
+    "bot.health_failures":       3,
+    "bot.display_timezone":      "UTC",
+    "bot.max_upload_mb":         50,
+    "bot.oversized_attachments": "skip",
+    "bot.attachment_order":      "after",
+    "bot.encrypted":             "note",
+    "bot.disable_preview":       true,
+    "smtp.listen_retries":       5,
+    "relay.port":                "25",
+    "http.recent_size":          50,
+}
+
+// setDefaults registers configDefaults with viper.
+func setDefaults() {
+    for key, value := range configDefaults {
+	viper.SetDefault(key, value)
+    }
+}
+
+// secretKeys are key name parts whose values -print-config hides.
+var secretKeys = []string{"token", "password", "secret"}
+
+// printConfig writes the effective configuration (file, environment
+// overrides and defaults) as json, with secrets and webhook urls hidden.
+func printConfig(w io.Writer) error {
+    settings := viper.AllSettings()
+    redact(settings)
+    out, err := json.MarshalIndent(settings, "", "  ")
+    if( err != nil ) {
+	return err
+    }
+    _, err = w.Write(append(out, '\n'))
+    return err
+}
+
+// redact hides secrets in nested settings maps: values of secret keys,
+// and webhook urls, which carry their own credentials.
+func redact(m map[string]interface{}) {
+    for key, value := range m {
+	switch v := value.(type) {
+	case map[string]interface{}:
+	    redact(v)
+	case string:
+	    if( v != "" && (isSecretKey(key) || strings.HasPrefix(v, "https://") || strings.HasPrefix(v, "http://")) ) {
+		m[key] = "<redacted>"
+	    }
+	}
+    }
+}
+
+func isSecretKey(key string) bool {
+    key = strings.ToLower(key)
+    for _, part := range secretKeys {
+	if strings.Contains(key, part) {
+	    return true
+	}
+    }
+    return false
+}
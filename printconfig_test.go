@@ -0,0 +1,32 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "testing"
+    "github.com/spf13/viper"
+)
+
+// -print-config shows the defaults the options are read with.
+func TestPrintConfigDefaults(t *testing.T) {
+    setDefaults()
+    var out bytes.Buffer
+    if err := printConfig(&out); err != nil {
+	t.Fatal(err)
+    }
+    var settings map[string]map[string]interface{}
+    if err := json.Unmarshal(out.Bytes(), &settings); err != nil {
+	t.Fatal(err)
+    }
+    for key, value := range configDefaults {
+	if( viper.Get(key) != value ) {
+	    t.Errorf("%s read as %v, want the default %v", key, viper.Get(key), value)
+	}
+    }
+    if settings["bot"]["disable_preview"] != true {
+	t.Errorf("bot.disable_preview shown as %v", settings["bot"]["disable_preview"])
+    }
+    if settings["smtp"]["listen_retries"] != float64(5) {
+	t.Errorf("smtp.listen_retries shown as %v", settings["smtp"]["listen_retries"])
+    }
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+    "time"
+)
+
+// quietWindow is a daily time range during which messages don't notify.
+type quietWindow struct {
+    start int // Minutes since midnight
+    end   int
+    loc   *time.Location
+}
+
+// quietHours maps receivers to their quiet window.
+var quietHours = map[string]*quietWindow{}
+
+// parseQuietWindow parses "HH:MM-HH:MM" optionally followed by a timezone
+// name, e.g. "23:00-07:00 Europe/Moscow". Local time is used by default.
+func parseQuietWindow(s string) (*quietWindow, error) {
+    fields := strings.Fields(s)
+    if( len(fields) == 0 || len(fields) > 2 ) {
+	return nil, fmt.Errorf("should be HH:MM-HH:MM [timezone]")
+    }
+    w := &quietWindow{loc: time.Local}
+    if( len(fields) == 2 ) {
+	loc, err := time.LoadLocation(fields[1])
+	if( err != nil ) {
+	    return nil, err
+	}
+	w.loc = loc
+    }
+    bounds := strings.Split(fields[0], "-")
+    if( len(bounds) != 2 ) {
+	return nil, fmt.Errorf("should be HH:MM-HH:MM [timezone]")
+    }
+    for i, b := range bounds {
+	t, err := time.Parse("15:04", b)
+	if( err != nil ) {
+	    return nil, err
+	}
+	if( i == 0 ) {
+	    w.start = t.Hour()*60 + t.Minute()
+	} else {
+	    w.end = t.Hour()*60 + t.Minute()
+	}
+    }
+    return w, nil
+}
+
+// contains reports whether t falls into the window, which may span midnight.
+func (w *quietWindow) contains(t time.Time) bool {
+    t = t.In(w.loc)
+    m := t.Hour()*60 + t.Minute()
+    if( w.start <= w.end ) {
+	return m >= w.start && m < w.end
+    }
+    return m >= w.start || m < w.end
+}
+
+// isQuiet reports whether the receiver is in its quiet hours now.
+func isQuiet(key string) bool {
+    w := quietHours[key]
+    if( w == nil ) {
+	w = quietHours["*"]
+    }
+    return w != nil && w.contains(time.Now())
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// rateLimiter is a token bucket allowing count messages per period.
+type rateLimiter struct {
+    mu     sync.Mutex
+    count  float64
+    period time.Duration
+    tokens float64
+    last   time.Time
+}
+
+// rateLimits holds the parsed [rate_limits] entries by receiver key.
+var rateLimits = map[string]*rateLimiter{}
+
+// limiters holds the buckets in use, one per receiver.
+var limiters = map[string]*rateLimiter{}
+var limitersMu sync.Mutex
+
+// parseRateLimit parses "count/period", e.g. "20/1m".
+func parseRateLimit(s string) (*rateLimiter, error) {
+    parts := strings.SplitN(s, "/", 2)
+    if( len(parts) != 2 ) {
+	return nil, fmt.Errorf("should be count/period, e.g. 20/1m")
+    }
+    count, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+    if( err != nil || count <= 0 ) {
+	return nil, fmt.Errorf("wrong count '%s'", parts[0])
+    }
+    period, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+    if( err != nil || period <= 0 ) {
+	return nil, fmt.Errorf("wrong period '%s'", parts[1])
+    }
+    return &rateLimiter{count: float64(count), period: period, tokens: float64(count)}, nil
+}
+
+// limiterFor returns the bucket of the receiver: its own limit, or a
+// separate bucket with the wildcard limit, nil if neither is configured.
+func limiterFor(key string) *rateLimiter {
+    limitersMu.Lock()
+    defer limitersMu.Unlock()
+    if l, ok := limiters[key]; ok {
+	return l
+    }
+    conf := rateLimits[key]
+    if( conf == nil ) {
+	conf = rateLimits["*"]
+    }
+    var l *rateLimiter
+    if( conf != nil ) {
+	l = &rateLimiter{count: conf.count, period: conf.period, tokens: conf.count}
+    }
+    limiters[key] = l
+    return l
+}
+
+// waitRate blocks until the receiver may send one more message.
+func waitRate(key string) {
+    if l := limiterFor(key); l != nil {
+	l.wait()
+    }
+}
+
+// wait takes a token, sleeping until one is available.
+func (l *rateLimiter) wait() {
+    for {
+	l.mu.Lock()
+	now := time.Now()
+	if( !l.last.IsZero() ) {
+	    l.tokens += now.Sub(l.last).Seconds() * l.count / l.period.Seconds()
+	    if( l.tokens > l.count ) {
+		l.tokens = l.count
+	    }
+	}
+	l.last = now
+	if( l.tokens >= 1 ) {
+	    l.tokens--
+	    l.mu.Unlock()
+	    return
+	}
+	need := time.Duration((1 - l.tokens) * float64(l.period) / l.count)
+	l.mu.Unlock()
+	time.Sleep(need)
+    }
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+    "crypto/subtle"
+    "html/template"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+)
+
+// recentMail is a relayed mail as listed by /recent.
+type recentMail struct {
+    Time    time.Time
+    From    string
+    To      string
+    Subject string
+    Status  string // "delivered", "skipped: ..." or "failed: ..."
+}
+
+// recent keeps the last relayed mails in a ring buffer.
+var recent struct {
+    mu    sync.Mutex
+    mails []recentMail
+    next  int
+}
+
+// initRecent sizes the ring buffer, keeping nothing if size is 0.
+func initRecent(size int) {
+    recent.mu.Lock()
+    recent.mails = make([]recentMail, 0, size)
+    recent.next = 0
+    recent.mu.Unlock()
+}
+
+// recordRecent adds a mail to the ring buffer, overwriting the oldest one
+// when full.
+func recordRecent(in *inbound, subject string, status string) {
+    m := recentMail{Time: time.Now(), From: in.From, To: strings.Join(in.To, ", "), Subject: subject, Status: status}
+    recent.mu.Lock()
+    defer recent.mu.Unlock()
+    if( cap(recent.mails) == 0 ) {
+	return
+    }
+    if( len(recent.mails) < cap(recent.mails) ) {
+	recent.mails = append(recent.mails, m)
+    } else {
+	recent.mails[recent.next] = m
+    }
+    recent.next = (recent.next + 1) % cap(recent.mails)
+}
+
+// recentMails returns the buffered mails, newest first.
+func recentMails() []recentMail {
+    recent.mu.Lock()
+    defer recent.mu.Unlock()
+    n := len(recent.mails)
+    mails := make([]recentMail, 0, n)
+    for i := 1; i <= n; i++ {
+	mails = append(mails, recent.mails[(recent.next-i+n)%n])
+    }
+    return mails
+}
+
+var recentPage = template.Must(template.New("recent").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>smtp2tg: recent mail</title>
+<style>td, th { padding: 2px 8px; text-align: left; } tr:nth-child(even) { background: #eee; }</style>
+</head><body>
+<h1>Recent mail</h1>
+<table>
+<tr><th>Time</th><th>From</th><th>To</th><th>Subject</th><th>Status</th></tr>
+{{range .}}<tr><td>{{.Time.Format "2006-01-02 15:04:05"}}</td><td>{{.From}}</td><td>{{.To}}</td><td>{{.Subject}}</td><td>{{.Status}}</td></tr>
+{{else}}<tr><td colspan="5">Nothing relayed yet</td></tr>
+{{end}}</table>
+</body></html>
+`))
+
+// recentHandler shows the buffered mails to clients presenting the
+// configured basic auth credentials.
+func recentHandler(user string, password string) http.HandlerFunc {
+    return func(w http.ResponseWriter, req *http.Request) {
+	u, p, ok := req.BasicAuth()
+	if( !ok || subtle.ConstantTimeCompare([]byte(u), []byte(user)) != 1 || subtle.ConstantTimeCompare([]byte(p), []byte(password)) != 1 ) {
+	    w.Header().Set("WWW-Authenticate", `Basic realm="smtp2tg"`)
+	    http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	    return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := recentPage.Execute(w, recentMails()); err != nil {
+	    logError("recent page: %s", err.Error())
+	}
+    }
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+    "bytes"
+    "encoding/base64"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "os"
+    "strings"
+    "testing"
+    "time"
+    "github.com/ircop/smtp2tg/smtpd"
+)
+
+// fakeSender counts what relay sends instead of sending it.
+type fakeSender struct {
+    texts, photos, documents int
+}
+
+func (s *fakeSender) SendText(r *route, text string) error {
+    s.texts++
+    return nil
+}
+
+func (s *fakeSender) SendPhoto(r *route, name string, data []byte) error {
+    s.photos++
+    return nil
+}
+
+func (s *fakeSender) SendDocument(r *route, name string, data []byte) error {
+    s.documents++
+    return nil
+}
+
+// benchRelay handles the raw mail b.N times as received over SMTP, from
+// the depth check and parsing to the delivery to a fake telegram sender.
+func benchRelay(b *testing.B, raw string) {
+    sender := &fakeSender{}
+    savedSender, savedReceivers := senders["telegram"], receivers
+    senders["telegram"], receivers = sender, map[string]string{"*": "1"}
+    log.SetOutput(ioutil.Discard)
+    defer func() {
+	senders["telegram"], receivers = savedSender, savedReceivers
+	log.SetOutput(os.Stderr)
+    }()
+
+    data := []byte(raw)
+    b.ReportAllocs()
+    b.SetBytes(int64(len(data)))
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+	mailHandler(&smtpd.Envelope{From: "<cam@example.com>", To: []string{"<alerts@example.org>"}, Data: data, Received: time.Now()})
+    }
+    b.StopTimer()
+    if( sender.texts+sender.photos+sender.documents == 0 ) {
+	b.Fatal("nothing relayed")
+    }
+}
+
+const benchHeader = "From: Camera <cam@example.com>\r\n" +
+    "To: alerts@example.org\r\n" +
+    "Subject: Motion detected\r\n" +
+    "Date: Mon, 02 Jan 2006 15:04:05 +0000\r\n" +
+    "MIME-Version: 1.0\r\n"
+
+func BenchmarkRelaySmallText(b *testing.B) {
+    benchRelay(b, benchHeader+
+	"Content-Type: text/plain; charset=utf-8\r\n\r\n"+
+	"Motion detected on the front door camera.\r\n")
+}
+
+func BenchmarkRelayLargeText(b *testing.B) {
+    line := "Lorem ipsum dolor sit amet, consectetur adipiscing elit, sed do eiusmod tempor.\r\n"
+    benchRelay(b, benchHeader+
+	"Content-Type: text/plain; charset=utf-8\r\n\r\n"+
+	strings.Repeat(line, 4000))
+}
+
+func BenchmarkRelayMultipartImages(b *testing.B) {
+    var raw bytes.Buffer
+    raw.WriteString(benchHeader)
+    raw.WriteString("Content-Type: multipart/mixed; boundary=\"bench\"\r\n\r\n")
+    raw.WriteString("--bench\r\nContent-Type: text/plain; charset=utf-8\r\n\r\nMotion on 3 cameras.\r\n")
+    // 64KB each, base64 in 76 character lines.
+    image := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0x89, 'P', 'N', 'G'}, 16<<10))
+    for i := 1; i <= 3; i++ {
+	fmt.Fprintf(&raw, "--bench\r\nContent-Type: image/png\r\nContent-Transfer-Encoding: base64\r\n"+
+	    "Content-Disposition: attachment; filename=\"cam%d.png\"\r\n\r\n", i)
+	for start := 0; start < len(image); start += 76 {
+	    end := start + 76
+	    if( end > len(image) ) {
+		end = len(image)
+	    }
+	    raw.WriteString(image[start:end] + "\r\n")
+	}
+    }
+    raw.WriteString("--bench--\r\n")
+    benchRelay(b, raw.String())
+}
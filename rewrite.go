@@ -0,0 +1,84 @@
+package main
+
+import (
+    "fmt"
+    "regexp"
+    "strings"
+)
+
+// rewrite is a [[rewrites]] rule, replacing matches of Pattern in the body
+// (and the subject if Subject is set).
+type rewrite struct {
+    Pattern string
+    Replace string
+    Subject bool
+    re      *regexp.Regexp
+}
+
+var rewrites []rewrite
+
+// compileRewrites compiles the patterns of the rules once at startup.
+func compileRewrites(rules []rewrite) error {
+    for i := range rules {
+	re, err := regexp.Compile(rules[i].Pattern)
+	if( err != nil ) {
+	    return fmt.Errorf("rewrite %d: %s", i+1, err.Error())
+	}
+	rules[i].re = re
+    }
+    rewrites = rules
+    return nil
+}
+
+// rewriteBody applies the rules to the text of a body. Replacements may
+// use $1 style references to the pattern groups.
+func rewriteBody(text string) string {
+    for _, rule := range rewrites {
+	text = rule.re.ReplaceAllString(text, rule.Replace)
+    }
+    return text
+}
+
+// rewriteSubject applies the rules enabled for the subject.
+func rewriteSubject(text string) string {
+    for _, rule := range rewrites {
+	if( rule.Subject ) {
+	    text = rule.re.ReplaceAllString(text, rule.Replace)
+	}
+    }
+    return text
+}
+
+// footers maps receivers to the markers of footers trimmed from bodies.
+var footers = map[string][]*regexp.Regexp{}
+
+// compileFooters compiles the [footers] markers once at startup. They
+// are multi-line patterns: ^ and $ match at line breaks.
+func compileFooters(conf map[string][]string) error {
+    for rcpt, patterns := range conf {
+	for _, pattern := range patterns {
+	    re, err := regexp.Compile("(?m)" + pattern)
+	    if( err != nil ) {
+		return fmt.Errorf("footer '%s' for '%s': %s", pattern, rcpt, err.Error())
+	    }
+	    footers[rcpt] = append(footers[rcpt], re)
+	}
+    }
+    return nil
+}
+
+// trimFooter cuts the body at the first footer marker of the receiver key
+// (or the wildcard ones), dropping the marker and everything after it.
+func trimFooter(key string, body string) string {
+    markers, ok := footers[key]
+    if( !ok ) {
+	markers = footers["*"]
+    }
+    cut := len(body)
+    for _, re := range markers {
+	if loc := re.FindStringIndex(body); loc != nil && loc[0] < cut {
+	    cut = loc[0]
+	}
+    }
+    return strings.TrimRight(body[:cut], " \t\r\n")
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "strings"
+    "github.com/ircop/smtp2tg/hooks"
+)
+
+// Sender delivers relayed mail content to one kind of destination.
+// Destinations are the values of the [receivers] table: a chat id for
+// telegram, a webhook url for slack and discord.
+type Sender interface {
+    SendText(r *route, text string) error
+    SendPhoto(r *route, name string, data []byte) error
+    SendDocument(r *route, name string, data []byte) error
+}
+
+// photoCaptioner is implemented by senders able to send a photo with the
+// text as its caption, in a single message.
+type photoCaptioner interface {
+    SendPhotoCaption(r *route, name string, caption string, data []byte) error
+}
+
+// captionLimit is the longest photo caption telegram accepts.
+const captionLimit = 1024
+
+// route is the destination a mail was resolved to, with the sender
+// delivering there.
+type route struct {
+    hooks.Route
+    Sender Sender
+}
+
+// senders holds the available backends by their config name.
+var senders = map[string]Sender{}
+
+// backends maps receivers to the backend used for them, telegram if not set.
+var backends map[string]string
+
+// receiverBackend returns the backend name configured for the receiver key.
+func receiverBackend(key string) string {
+    if( key == "fallback" || key == "bounces" || key == "dead_letter" || key == "chat_header" ) {
+	return "telegram"
+    }
+    if( backends[key] != "" ) {
+	return strings.ToLower(backends[key])
+    }
+    return "telegram"
+}
+
+// newRoute builds the route for the receiver key and destination.
+func newRoute(key string, dest string) (*route, error) {
+    backend := receiverBackend(key)
+    sender, ok := senders[backend]
+    if( !ok ) {
+	return nil, fmt.Errorf("unknown backend '%s' for '%s'", backend, key)
+    }
+    return &route{Route: hooks.Route{Key: key, Dest: dest, Backend: backend}, Sender: sender}, nil
+}
+
+// checkReceivers validates receivers destinations against their backends.
+func checkReceivers() {
+    for key, dest := range receivers {
+	r, err := newRoute(key, dest)
+	if( err != nil ) {
+	    log.Fatal(err.Error())
+	}
+	if( r.Backend == "telegram" ) {
+	    if _, err := chatID(r); err != nil {
+		log.Fatal(err.Error())
+	    }
+	} else if( !strings.HasPrefix(dest, "https://") && !strings.HasPrefix(dest, "http://") ) {
+	    log.Fatalf("Receiver '%s' uses %s backend, its destination should be a webhook url", key, r.Backend)
+	}
+    }
+}
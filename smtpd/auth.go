@@ -0,0 +1,161 @@
+package smtpd
+
+import (
+    "bytes"
+    "crypto/subtle"
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "log"
+    "sort"
+    "strings"
+)
+
+// AuthMechanism runs one SASL exchange. Next is called with each decoded
+// client response, starting with the initial one (empty if the client
+// sent none). It returns a challenge when it needs more data, done once the
+// client is authenticated, or an error if the credentials are invalid.
+type AuthMechanism interface {
+    Next(response []byte) (challenge []byte, done bool, err error)
+}
+
+// AuthMechanisms maps mechanism names (e.g. "PLAIN") to constructors of
+// their state for a new exchange.
+type AuthMechanisms map[string]func() AuthMechanism
+
+var errAuthFailed = errors.New("authentication failed")
+
+// names returns the sorted mechanism names for the EHLO AUTH keyword.
+func (m AuthMechanisms) names() []string {
+    var names []string
+    for name := range m {
+	names = append(names, strings.ToUpper(name))
+    }
+    sort.Strings(names)
+    return names
+}
+
+// lookup finds the mechanism case-insensitively.
+func (m AuthMechanisms) lookup(name string) func() AuthMechanism {
+    for n, f := range m {
+	if strings.EqualFold(n, name) {
+	    return f
+	}
+    }
+    return nil
+}
+
+// PlainAuth returns the PLAIN mechanism (RFC 4616), checking credentials with check.
+func PlainAuth(check func(user, password string) bool) func() AuthMechanism {
+    return func() AuthMechanism { return &plainAuth{check: check} }
+}
+
+type plainAuth struct {
+    check func(user, password string) bool
+}
+
+func (a *plainAuth) Next(response []byte) ([]byte, bool, error) {
+    if len(response) == 0 {
+	return []byte{}, false, nil
+    }
+    // authzid \0 authcid \0 password
+    fields := bytes.Split(response, []byte{0})
+    if len(fields) != 3 || !a.check(string(fields[1]), string(fields[2])) {
+	return nil, false, errAuthFailed
+    }
+    return nil, true, nil
+}
+
+// BearerAuth returns the XOAUTH2 mechanism, checking the user and the
+// bearer token with check.
+func BearerAuth(check func(user, token string) bool) func() AuthMechanism {
+    return func() AuthMechanism { return &bearerAuth{check: check} }
+}
+
+// SharedSecret returns a check accepting any user presenting secret.
+func SharedSecret(secret string) func(user, token string) bool {
+    return func(user, token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+    }
+}
+
+type bearerAuth struct {
+    check  func(user, token string) bool
+    failed bool
+}
+
+func (a *bearerAuth) Next(response []byte) ([]byte, bool, error) {
+    if a.failed {
+	// Client acknowledged the error challenge.
+	return nil, false, errAuthFailed
+    }
+    if len(response) == 0 {
+	return []byte{}, false, nil
+    }
+    // "user=" user ^A "auth=Bearer " token ^A ^A
+    var user, token string
+    for _, field := range strings.Split(string(response), "\x01") {
+	if strings.HasPrefix(field, "user=") {
+	    user = field[len("user="):]
+	} else if strings.HasPrefix(field, "auth=Bearer ") {
+	    token = field[len("auth=Bearer "):]
+	}
+    }
+    if token == "" || !a.check(user, token) {
+	// XOAUTH2 sends the error as a challenge the client has to answer.
+	a.failed = true
+	return []byte(`{"status":"401"}`), false, nil
+    }
+    return nil, true, nil
+}
+
+// Run an AUTH exchange, returns whether the client authenticated.
+func (s *session) auth(args string) bool {
+    fields := strings.Fields(args)
+    if len(fields) == 0 || len(fields) > 2 {
+	s.writef("501 Syntax error in parameters or arguments")
+	return false
+    }
+    newMech := s.srv.Auth.lookup(fields[0])
+    if newMech == nil {
+	s.writef("504 Unrecognized authentication type")
+	log.Printf("[ERR]: 504 Unrecognized authentication type %s", fields[0])
+	return false
+    }
+    mech := newMech()
+
+    var response []byte
+    if len(fields) == 2 && fields[1] != "=" {
+	var err error
+	if response, err = base64.StdEncoding.DecodeString(fields[1]); err != nil {
+	    s.writef("501 Syntax error in parameters or arguments (invalid base64)")
+	    return false
+	}
+    }
+    for {
+	challenge, done, err := mech.Next(response)
+	if err != nil {
+	    s.writef("535 Authentication credentials invalid")
+	    log.Printf("[ERR]: 535 %s authentication failed from %s", strings.ToUpper(fields[0]), s.remoteIP)
+	    return false
+	}
+	if done {
+	    s.writef("235 Authentication successful")
+	    Debug(fmt.Sprintf("Authenticated with %s", strings.ToUpper(fields[0])))
+	    return true
+	}
+	s.writef("334 %s", base64.StdEncoding.EncodeToString(challenge))
+	line, err := s.readLine()
+	if err != nil {
+	    return false
+	}
+	if line == "*" {
+	    s.writef("501 Authentication cancelled")
+	    return false
+	}
+	if response, err = base64.StdEncoding.DecodeString(line); err != nil {
+	    s.writef("501 Syntax error in parameters or arguments (invalid base64)")
+	    return false
+	}
+    }
+}
@@ -0,0 +1,47 @@
+package smtpd
+
+// Enhanced status codes (RFC 2034, RFC 3463), added to the replies of
+// sessions started with EHLO when Server.EnhancedCodes is set.
+
+// enhancedCodes maps "VERB code" or just the reply code to the enhanced
+// code told with it. Intermediate (3xx) replies have none.
+var enhancedCodes = map[string]string{
+    "MAIL 250": "2.1.0",
+    "RCPT 250": "2.1.5",
+    "RCPT 452": "4.5.3",
+    "MAIL 550": "5.7.23",
+    "DATA 554": "5.6.0",
+    "250":      "2.0.0",
+    "214":      "2.0.0",
+    "221":      "2.0.0",
+    "235":      "2.7.0",
+    "421":      "4.7.0",
+    "451":      "4.3.0",
+    "452":      "4.5.3",
+    "500":      "5.5.2",
+    "501":      "5.5.4",
+    "502":      "5.5.1",
+    "503":      "5.5.1",
+    "504":      "5.5.4",
+    "530":      "5.7.0",
+    "535":      "5.7.8",
+    "550":      "5.7.1",
+    "554":      "5.7.1",
+}
+
+// Insert the enhanced code of the reply line after its reply code, for
+// the command being answered.
+func (s *session) enhance(line string) string {
+    if len(line) < 4 || line[3] != ' ' {
+	return line
+    }
+    code := line[:3]
+    enhanced, ok := enhancedCodes[s.verb+" "+code]
+    if !ok {
+	enhanced, ok = enhancedCodes[code]
+    }
+    if !ok {
+	return line
+    }
+    return code + " " + enhanced + line[3:]
+}
@@ -0,0 +1,152 @@
+package smtpd
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// PROXY protocol (https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt):
+// a load balancer in front of the server passes the client address in a
+// header preceding the SMTP conversation, a text line (v1) or a binary
+// block (v2).
+
+// proxyV2Sig starts every v2 header.
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// How long the balancer may take to send the header.
+const proxyTimeout = 10 * time.Second
+
+// Longest v1 line, CRLF included.
+const proxyV1Max = 107
+
+// Read the PROXY header of the connection, either version, and return the
+// client address it gives, nil if it gives none (v1 UNKNOWN, v2 LOCAL
+// health checks of the balancer, unix sockets).
+func (s *session) readProxyHeader() (net.Addr, error) {
+    s.conn.SetReadDeadline(time.Now().Add(proxyTimeout))
+    defer s.conn.SetReadDeadline(time.Time{})
+    sig, err := s.br.Peek(len(proxyV2Sig))
+    if err != nil {
+	return nil, err
+    }
+    if bytes.Equal(sig, proxyV2Sig) {
+	return s.readProxyV2()
+    }
+    return s.readProxyV1()
+}
+
+// Read a v1 header: "PROXY TCP4 src dst sport dport\r\n".
+func (s *session) readProxyV1() (net.Addr, error) {
+    // Don't read on from a client not speaking the protocol.
+    var line []byte
+    for len(line) < proxyV1Max && !bytes.HasSuffix(line, []byte("\n")) {
+	b, err := s.br.ReadByte()
+	if err != nil {
+	    return nil, err
+	}
+	line = append(line, b)
+    }
+    if !bytes.HasSuffix(line, []byte("\r\n")) {
+	return nil, errors.New("no PROXY header")
+    }
+    fields := strings.Fields(string(line))
+    if len(fields) < 2 || fields[0] != "PROXY" {
+	return nil, errors.New("no PROXY header")
+    }
+    switch fields[1] {
+    case "UNKNOWN":
+	return nil, nil
+    case "TCP4", "TCP6":
+    default:
+	return nil, fmt.Errorf("PROXY v1: unknown protocol %q", fields[1])
+    }
+    if len(fields) != 6 {
+	return nil, fmt.Errorf("PROXY v1: %d fields instead of 6", len(fields))
+    }
+    ip := net.ParseIP(fields[2])
+    port, err := strconv.Atoi(fields[4])
+    if ip == nil || err != nil || port < 0 || port > 65535 {
+	return nil, fmt.Errorf("PROXY v1: wrong source address %s port %s", fields[2], fields[4])
+    }
+    return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// Read a v2 header: signature, version and command, address family,
+// length, then the addresses followed by TLV vectors.
+func (s *session) readProxyV2() (net.Addr, error) {
+    head := make([]byte, 16)
+    if _, err := io.ReadFull(s.br, head); err != nil {
+	return nil, err
+    }
+    if head[12]>>4 != 2 {
+	return nil, fmt.Errorf("PROXY v2: unknown version %d", head[12]>>4)
+    }
+    body := make([]byte, binary.BigEndian.Uint16(head[14:16]))
+    if _, err := io.ReadFull(s.br, body); err != nil {
+	return nil, err
+    }
+    switch head[12] & 0x0f {
+    case 0:
+	// LOCAL: the balancer's own connection, e.g. a health check.
+	return nil, nil
+    case 1:
+	// PROXY
+    default:
+	return nil, fmt.Errorf("PROXY v2: unknown command %d", head[12]&0x0f)
+    }
+    var addr *net.TCPAddr
+    var tlvs []byte
+    switch head[13] >> 4 {
+    case 1:
+	// AF_INET: source and destination addresses, then ports.
+	if len(body) < 12 {
+	    return nil, errors.New("PROXY v2: short IPv4 address block")
+	}
+	addr = &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}
+	tlvs = body[12:]
+    case 2:
+	// AF_INET6
+	if len(body) < 36 {
+	    return nil, errors.New("PROXY v2: short IPv6 address block")
+	}
+	addr = &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}
+	tlvs = body[36:]
+    default:
+	// AF_UNSPEC or AF_UNIX: no address to use.
+	return nil, nil
+    }
+    if err := proxyTLVs(tlvs); err != nil {
+	return nil, err
+    }
+    return addr, nil
+}
+
+// Check the type-length-value vectors following the v2 addresses,
+// debug-logging the ones telling about the client.
+func proxyTLVs(tlvs []byte) error {
+    for len(tlvs) > 0 {
+	if len(tlvs) < 3 {
+	    return errors.New("PROXY v2: truncated TLV")
+	}
+	typ, n := tlvs[0], int(binary.BigEndian.Uint16(tlvs[1:3]))
+	if len(tlvs) < 3+n {
+	    return fmt.Errorf("PROXY v2: truncated TLV 0x%02x", typ)
+	}
+	value := tlvs[3 : 3+n]
+	switch typ {
+	case 0x02:
+	    Debug( fmt.Sprintf("PROXY v2 authority: %s", value) )
+	case 0x05:
+	    Debug( fmt.Sprintf("PROXY v2 unique id: %x", value) )
+	}
+	tlvs = tlvs[3+n:]
+    }
+    return nil
+}
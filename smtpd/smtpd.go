@@ -2,14 +2,23 @@
 package smtpd
 
 import (
+    "context"
+    "crypto/rand"
+    "crypto/tls"
+    "encoding/hex"
     "log"
     "bufio"
     "bytes"
     "fmt"
+    "io"
     "net"
     "os"
+    "path"
     "regexp"
+    "strconv"
     "strings"
+    "sync"
+    "sync/atomic"
     "time"
 )
 
@@ -17,10 +26,31 @@ var (
     rcptToRE   = regexp.MustCompile(`[Tt][Oo]:(.+)`)
     mailFromRE = regexp.MustCompile(`[Ff][Rr][Oo][Mm]:(.*)`) // Delivery Status Notifications are sent with "MAIL FROM:<>"
     debug = false
+    headerLineRE = regexp.MustCompile(`^([!-9;-~]+:|[ \t])`) // Header field or its continuation
+    maxSizeHint = 1 << 20 // Largest SIZE hint readData preallocates for
+    helpLines = []string{
+	"Supported commands:",
+	"  EHLO HELO STARTTLS AUTH MAIL RCPT DATA",
+	"  RSET NOOP HELP QUIT",
+	"End of HELP info",
+    }
 )
 
+// Envelope is a received mail with the context of its transaction.
+type Envelope struct {
+    RemoteAddr net.Addr  // Client address
+    LocalAddr  net.Addr  // Address of the listener that accepted the connection
+    Helo       string    // Name the client gave with EHLO/HELO
+    SPF        string    // SPF result if Server.SPF says to tag it, empty otherwise
+    Received   time.Time // When DATA was complete
+    ID         string    // Transaction id given to the client in the 250 reply
+    From       string
+    To         []string
+    Data       []byte
+}
+
 // Handler function called upon successful receipt of an email.
-type Handler func(remoteAddr net.Addr, from string, to []string, data []byte)
+type Handler func(env *Envelope)
 
 // ListenAndServe listens on the TCP network address addr
 // and then calls Serve with handler to handle requests
@@ -33,10 +63,50 @@ func ListenAndServe(addr string, handler Handler, appname string, hostname strin
 
 // Server is an SMTP server.
 type Server struct {
-    Addr     string // TCP address to listen on, defaults to ":25" (all addresses, port 25) if empty
-    Handler  Handler
-    Appname  string
-    Hostname string
+    Addr         string         // TCP address to listen on, defaults to ":25" (all addresses, port 25) if empty
+    Handler      Handler
+    Appname      string
+    Hostname     string
+    KeepAlive    time.Duration  // TCP keepalive period for accepted connections, system default if zero, disabled if negative
+    Resolver     *net.Resolver  // Resolver for reverse lookups of clients, system one if nil
+    MaxHandlers  int            // Maximum concurrent Handler calls, unlimited if zero
+    HandlerWait  time.Duration  // How long DATA waits for a busy handler slot before replying 451, forever if zero
+    Auth         AuthMechanisms // AUTH mechanisms offered, AUTH is not advertised if empty
+    AuthRequired bool           // Refuse MAIL until the client authenticated
+    RequireHelo  bool           // Refuse MAIL until the client sent EHLO/HELO
+    RejectEmpty  bool           // Answer 554 to mail with no body (empty, or headers only)
+    MaxConnRcpts int            // RCPT commands allowed per connection, over all its mails, unlimited if zero
+    MaxBadRcpts  int            // Refused RCPT commands after which the connection is dropped, unlimited if zero
+    EnhancedCodes bool          // Advertise ENHANCEDSTATUSCODES and add them to the replies of EHLO sessions
+    MaxCmdRate   int            // Commands per second a client may send before being dropped, unlimited if zero
+    GreetPause   time.Duration  // Delay of the banner, clients talking before it are dropped
+    AccessLog    io.Writer      // Receives a line per transaction and per connection if set
+    MaxMessages  int            // Mails accepted per connection before asking to reconnect, unlimited if zero
+    TLSConfig    *tls.Config    // Offer STARTTLS with this config if set
+    NoReceived   bool           // Don't prepend Received headers, keeping client names and addresses out of the data
+    SPF          map[string]string // Action (SPFAllow, SPFTag, SPFReject) by SPF result ("fail", "softfail"...), no check if empty
+    AllowedHelo  []string       // EHLO/HELO name patterns (path.Match syntax) of the clients served, all if empty. Implies RequireHelo
+    ProxyProtocol bool          // Expect a PROXY protocol header (v1 or v2) from a load balancer on every connection
+
+    initOnce     sync.Once
+    handlerSlots chan struct{}
+    accessMu     sync.Mutex
+    maintenance  int32
+}
+
+// SetMaintenance switches maintenance mode: while on, MAIL is answered
+// with 421 so clients retry later. Safe to call while serving.
+func (srv *Server) SetMaintenance(on bool) {
+    var v int32
+    if on {
+	v = 1
+    }
+    atomic.StoreInt32(&srv.maintenance, v)
+}
+
+// Maintenance reports whether maintenance mode is on.
+func (srv *Server) Maintenance() bool {
+    return atomic.LoadInt32(&srv.maintenance) == 1
 }
 
 // ListenAndServe listens on the TCP network address srv.Addr and then
@@ -46,12 +116,6 @@ func (srv *Server) ListenAndServe() error {
     if srv.Addr == "" {
 	srv.Addr = ":25"
     }
-    if srv.Appname == "" {
-	srv.Appname = "smtpd"
-    }
-    if srv.Hostname == "" {
-	srv.Hostname, _ = os.Hostname()
-    }
     ln, err := net.Listen("tcp", srv.Addr)
     if err != nil {
 	return err
@@ -62,6 +126,7 @@ func (srv *Server) ListenAndServe() error {
 // Serve creates a new SMTP session after a network connection is established.
 func (srv *Server) Serve(ln net.Listener) error {
     defer ln.Close()
+    srv.init()
     for {
 	conn, err := ln.Accept()
 	if err != nil {
@@ -70,6 +135,7 @@ func (srv *Server) Serve(ln net.Listener) error {
 	    }
 	    return err
 	}
+	srv.setKeepAlive(conn)
 	session, err := srv.newSession(conn)
 	if err != nil {
 	    continue
@@ -78,14 +144,149 @@ func (srv *Server) Serve(ln net.Listener) error {
     }
 }
 
+// ServeConn runs an SMTP session on an already established connection,
+// returning when the session ends.
+func (srv *Server) ServeConn(conn net.Conn) {
+    srv.init()
+    session, err := srv.newSession(conn)
+    if err != nil {
+	conn.Close()
+	return
+    }
+    session.serve()
+}
+
+// Prepare the server state shared by sessions.
+func (srv *Server) init() {
+    srv.initOnce.Do(func() {
+	if srv.Appname == "" {
+	    srv.Appname = "smtpd"
+	}
+	if srv.Hostname == "" {
+	    srv.Hostname, _ = os.Hostname()
+	}
+	if srv.MaxHandlers > 0 {
+	    srv.handlerSlots = make(chan struct{}, srv.MaxHandlers)
+	}
+    })
+}
+
+// Wait for a free handler slot, if handler calls are bounded. Returns
+// false if none got free within HandlerWait.
+func (srv *Server) acquireHandler() bool {
+    if srv.handlerSlots == nil {
+	return true
+    }
+    if srv.HandlerWait <= 0 {
+	srv.handlerSlots <- struct{}{}
+	return true
+    }
+    timer := time.NewTimer(srv.HandlerWait)
+    defer timer.Stop()
+    select {
+    case srv.handlerSlots <- struct{}{}:
+	return true
+    case <-timer.C:
+	return false
+    }
+}
+
+// Go runs f on a goroutine of its own in a handler slot, so work started
+// outside SMTP sessions (HTTP submissions) shares the MaxHandlers bound.
+// It returns false without running f if no slot got free within
+// HandlerWait.
+func (srv *Server) Go(f func()) bool {
+    srv.init()
+    if !srv.acquireHandler() {
+	return false
+    }
+    go func() {
+	if srv.handlerSlots != nil {
+	    defer func() { <-srv.handlerSlots }()
+	}
+	f()
+    }()
+    return true
+}
+
+// Call the handler and release the slot taken by acquireHandler.
+func (srv *Server) runHandler(env *Envelope) {
+    if srv.handlerSlots != nil {
+	defer func() { <-srv.handlerSlots }()
+    }
+    if srv.Handler != nil {
+	srv.Handler(env)
+    }
+}
+
+// Report whether the EHLO/HELO name matches one of AllowedHelo, or any
+// name is allowed.
+func (srv *Server) heloAllowed(name string) bool {
+    if len(srv.AllowedHelo) == 0 {
+	return true
+    }
+    name = strings.ToLower(name)
+    for _, pattern := range srv.AllowedHelo {
+	if ok, _ := path.Match(strings.ToLower(pattern), name); ok {
+	    return true
+	}
+    }
+    return false
+}
+
+// Enable TCP keepalive on the connection so dead peers are detected
+// instead of blocking the session forever.
+func (srv *Server) setKeepAlive(conn net.Conn) {
+    tcp, ok := conn.(*net.TCPConn)
+    if !ok || srv.KeepAlive == 0 {
+	return
+    }
+    if srv.KeepAlive < 0 {
+	tcp.SetKeepAlive(false)
+	return
+    }
+    tcp.SetKeepAlive(true)
+    tcp.SetKeepAlivePeriod(srv.KeepAlive)
+}
+
+// NewResolver returns a resolver querying the DNS server at addr
+// ("host" or "host:port") instead of the system configured ones.
+func NewResolver(addr string) *net.Resolver {
+    if _, _, err := net.SplitHostPort(addr); err != nil {
+	addr = net.JoinHostPort(addr, "53")
+    }
+    return &net.Resolver{
+	PreferGo: true,
+	Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+	    var d net.Dialer
+	    return d.DialContext(ctx, network, addr)
+	},
+    }
+}
+
 type session struct {
-    srv        *Server
-    conn       net.Conn
-    br         *bufio.Reader
-    bw         *bufio.Writer
-    remoteIP   string // Remote IP address
-    remoteHost string // Remote hostname according to reverse DNS lookup
-    remoteName string // Remote hostname as supplied with EHLO
+    srv           *Server
+    conn          net.Conn
+    br            *bufio.Reader
+    bw            *bufio.Writer
+    remoteAddr    net.Addr // Client address, from the PROXY header if any
+    remoteIP      string // Remote IP address
+    remoteHost    string // Remote hostname according to reverse DNS lookup, see host()
+    ptr           chan string // Receives the result of the reverse DNS lookup
+    remoteName    string // Remote hostname as supplied with EHLO
+    authenticated bool   // Client passed AUTH
+    messages      int    // Mails accepted in this session
+    tls           bool   // STARTTLS done
+    sizeHint      int    // SIZE announced with MAIL, 0 if none
+    rcpts         int    // RCPT commands in this session
+    rcptsRefused  int    // RCPT commands refused in this session
+    spfResult     string // SPF result of the current transaction, empty if not checked
+    spfTag        bool   // Mail of the current transaction is tagged with spfResult
+    txid          string // Id of the mail just queued, for the access log
+    cmdSecond     time.Time // Start of the second commands are being counted in
+    cmds          int    // Commands in that second
+    verb          string // Command being answered
+    enhanced      bool   // Replies carry enhanced status codes
 }
 
 // Create new session from connection.
@@ -101,22 +302,43 @@ func (srv *Server) newSession(conn net.Conn) (s *session, err error) {
 
 // Function called to handle connection requests.
 func (s *session) serve() {
-    defer s.conn.Close()
+    // STARTTLS replaces s.conn, close whichever is current.
+    defer func() { s.conn.Close() }()
+    statsSessionStart()
+    defer statsSessionEnd()
     var from string
     var to []string
-    var buffer bytes.Buffer
 
-    // Get remote end info for the Received header.
-    s.remoteIP, _, _ = net.SplitHostPort(s.conn.RemoteAddr().String())
-    names, err := net.LookupAddr(s.remoteIP)
-    if err == nil && len(names) > 0 {
-	s.remoteHost = names[0]
-    } else {
-	s.remoteHost = "unknown"
+    // Get remote end info for the Received header. The reverse lookup
+    // runs in the background, so it never delays the greeting.
+    s.remoteAddr = s.conn.RemoteAddr()
+    if s.srv.ProxyProtocol {
+	addr, err := s.readProxyHeader()
+	if err != nil {
+	    log.Printf("[ERR]: PROXY header from %s: %s, dropping connection", s.remoteAddr, err.Error())
+	    return
+	}
+	if addr != nil {
+	    Debug( fmt.Sprintf("Connection from %s proxied by %s", addr, s.remoteAddr) )
+	    s.remoteAddr = addr
+	}
     }
+    s.remoteIP, _, _ = net.SplitHostPort(s.remoteAddr.String())
+    s.ptr = make(chan string, 1)
+    go s.lookupHost()
 
     Debug( fmt.Sprintf("Incomming connection from %s", s.remoteIP) )
 
+    result := "closed"
+    defer func() {
+	s.access("event=conn remote=%s host=%s helo=%q messages=%d result=%s", s.remoteIP, s.host(), s.remoteName, s.messages, result)
+    }()
+
+    if !s.greetPause() {
+	result = "dropped"
+	return
+    }
+
     // Send banner.
     s.writef("220 %s %s SMTP Service ready", s.srv.Hostname, s.srv.Appname)
     
@@ -131,36 +353,152 @@ loop:
 	    break
 	}
 	verb, args := s.parseLine(line)
+	s.verb = verb
+	if s.commandFlood() {
+	    result = "flood"
+	    break
+	}
 
 	switch verb {
 	case "EHLO", "HELO":
-	    s.remoteName = args
+	    s.remoteName = strings.TrimSpace(args)
 	    Debug( fmt.Sprintf("Received %s from %s", verb, s.remoteName) )
-	    s.writef("250 %s greets %s", s.srv.Hostname, s.remoteName)
-	    Debug( fmt.Sprintf("Sent: 250 %s greets %s", s.srv.Hostname, s.remoteName) )
+	    if !s.srv.heloAllowed(s.remoteName) {
+		s.writef("550 Access denied (%s not allowed)", verb)
+		log.Printf("[ERR]: 550 %s %s from %s not allowed, dropping connection", verb, s.remoteName, s.remoteIP)
+		result = "helo"
+		break loop
+	    }
+	    greeting := fmt.Sprintf("%s greets %s", s.srv.Hostname, s.remoteName)
+	    extensions := []string{greeting}
+	    if verb == "EHLO" && len(s.srv.Auth) > 0 {
+		extensions = append(extensions, "AUTH " + strings.Join(s.srv.Auth.names(), " "))
+	    }
+	    if verb == "EHLO" {
+		// Lets clients announce the mail size, see readData.
+		extensions = append(extensions, "SIZE")
+	    }
+	    if verb == "EHLO" && s.srv.TLSConfig != nil && !s.tls {
+		extensions = append(extensions, "STARTTLS")
+	    }
+	    if verb == "EHLO" && s.srv.EnhancedCodes {
+		extensions = append(extensions, "ENHANCEDSTATUSCODES")
+	    }
+	    s.enhanced = verb == "EHLO" && s.srv.EnhancedCodes
+	    s.writeMulti(250, extensions)
+	    // The whole reply, so interop issues can be told from the log alone.
+	    for i, line := range extensions {
+		sep := "-"
+		if i == len(extensions)-1 {
+		    sep = " "
+		}
+		Debug( fmt.Sprintf("Sent: 250%s%s", sep, line) )
+	    }
 
 	    // RFC 2821 section 4.1.4 specifies that EHLO has the same effect as RSET.
 	    from = ""
 	    to = nil
-	    buffer.Reset()
+	    s.sizeHint = 0
+	case "STARTTLS":
+	    Debug( "Received STARTTLS" )
+	    if s.srv.TLSConfig == nil {
+		s.writef("502 Command not implemented")
+		break
+	    }
+	    if s.tls {
+		s.writef("503 Bad sequence of commands (TLS already active)")
+		break
+	    }
+	    s.writef("220 Ready to start TLS")
+	    if err := s.startTLS(); err != nil {
+		log.Printf("[ERR]: TLS handshake with %s: %s", s.remoteIP, err.Error())
+		break loop
+	    }
+	    // RFC 3207 section 4.2: forget what the client said before TLS.
+	    s.remoteName = ""
+	    s.authenticated = false
+	    s.enhanced = false
+	    from = ""
+	    to = nil
+	    s.sizeHint = 0
+	case "AUTH":
+	    Debug( "Received AUTH" )
+	    if len(s.srv.Auth) == 0 {
+		s.writef("502 Command not implemented")
+		break
+	    }
+	    if s.authenticated {
+		s.writef("503 Bad sequence of commands (already authenticated)")
+		break
+	    }
+	    s.authenticated = s.auth(args)
 	case "MAIL":
 	    Debug(fmt.Sprintf("Received MAIL (%s)", args) )
+	    // Clients skipping EHLO/HELO would get past AllowedHelo.
+	    if (s.srv.RequireHelo || len(s.srv.AllowedHelo) > 0) && s.remoteName == "" {
+		s.writef("503 Bad sequence of commands (EHLO/HELO required)")
+		log.Printf("[ERR]: 503 MAIL without EHLO/HELO from %s", s.remoteIP)
+		break
+	    }
+	    if s.srv.AuthRequired && !s.authenticated {
+		s.writef("530 Authentication required")
+		log.Printf("[ERR]: 530 Authentication required")
+		break
+	    }
+	    if s.srv.Maintenance() {
+		s.writef("421 Service not available, try later")
+		log.Printf("[ERR]: 421 maintenance mode, refusing mail from %s", s.remoteIP)
+		result = "maintenance"
+		break loop
+	    }
+	    if s.srv.MaxMessages > 0 && s.messages >= s.srv.MaxMessages {
+		s.writef("421 Too many messages this session")
+		log.Printf("[ERR]: 421 %s sent %d messages, closing connection", s.remoteIP, s.messages)
+		result = "limit"
+		break loop
+	    }
 	    match := mailFromRE.FindStringSubmatch(args)
 	    if match == nil {
 		s.writef("501 Syntax error in parameters or arguments (invalid FROM parameter)")
 		log.Printf("[ERR]: 501 Syntax error in parameters or arguments (invalid FROM parameter)")
 	    } else {
-		from = match[1]
+		debugParams("MAIL", match[1])
+		// Check the address alone, without SIZE= and other parameters.
+		addr, size := mailParams(match[1])
+		s.spfResult, s.spfTag = "", false
+		if len(s.srv.SPF) > 0 {
+		    result, action := s.checkSPF(addr)
+		    if action == SPFReject {
+			s.writef("550 SPF check failed (%s)", result)
+			log.Printf("[ERR]: 550 SPF %s for %s from %s", result, addr, s.remoteIP)
+			from = ""
+			to = nil
+			s.sizeHint = 0
+			break
+		    }
+		    s.spfResult, s.spfTag = result, action == SPFTag
+		}
+		from, s.sizeHint = addr, size
 		s.writef("250 Ok")
 		Debug("Sent: 250 Ok")
 	    }
 	    to = nil
-	    buffer.Reset()
 	case "RCPT":
 	    Debug(fmt.Sprintf("Received RCPT (%s)", args) )
+	    s.rcpts++
+	    if s.srv.MaxConnRcpts > 0 && s.rcpts > s.srv.MaxConnRcpts {
+		s.writef("421 Too many recipients this session")
+		log.Printf("[ERR]: 421 %s sent more than %d RCPT, closing connection", s.remoteIP, s.srv.MaxConnRcpts)
+		result = "rcpt_abuse"
+		break loop
+	    }
 	    if from == "" {
 		s.writef("503 Bad sequence of commands (MAIL required before RCPT)")
 		log.Printf("[ERR]: 503 Bad sequence of commands (MAIL required before RCPT)")
+		if s.refusedRcpt() {
+		    result = "rcpt_abuse"
+		    break loop
+		}
 		break
 	    }
 
@@ -168,11 +506,26 @@ loop:
 	    if match == nil {
 		s.writef("501 Syntax error in parameters or arguments (invalid TO parameter)")
 		log.Printf("[ERR]: 501 Syntax error in parameters or arguments (invalid TO parameter)")
+		if s.refusedRcpt() {
+		    result = "rcpt_abuse"
+		    break loop
+		}
 	    } else {
+		debugParams("RCPT", match[1])
+		match[1] = stripSourceRoute(match[1])
 		// RFC 5321 specifies 100 minimum recipients
-		if len(to) == 100 {
+		if hasRecipient(to, match[1]) {
+		    // Accept a repeated RCPT, but deliver only once.
+		    Debug( fmt.Sprintf("Duplicate recipient %s", match[1]) )
+		    s.writef("250 Ok")
+		    Debug( "Sent: 250 Ok" )
+		} else if len(to) == 100 {
 		    s.writef("452 Too many recipients")
 		    log.Printf("[ERR]: 452 Too many recipients")
+		    if s.refusedRcpt() {
+			result = "rcpt_abuse"
+			break loop
+		    }
 		} else {
 		    to = append(to, match[1])
 		    Debug( fmt.Sprintf("to: %s", to) )
@@ -193,41 +546,93 @@ loop:
 	    // Attempt to read message body from the socket.
 	    // On error, assume the client has gone away i.e. return from serve().
 	    data, err := s.readData()
+	    received := time.Now()
 	    if err != nil {
 		log.Printf("[ERR]: %s", err.Error())
+		SetLastError(err.Error())
+		s.accessMail(from, to, len(data), "error")
 		break loop
 	    }
 
-	    // Create Received header & write message body into buffer.
-	    buffer.Reset()
-	    buffer.Write(s.makeHeaders(to))
-	    buffer.Write(data)
-	    Debug("Sent: 250 Ok: queued")
-	    s.writef("250 Ok: queued")
+	    if s.srv.RejectEmpty && emptyMessage(data) {
+		s.writef("554 Empty message")
+		log.Printf("[ERR]: 554 Empty message from %s", from)
+		s.accessMail(from, to, len(data), "empty")
+		from = ""
+		to = nil
+		s.sizeHint = 0
+		break
+	    }
+
+	    // Create Received header & prepend it to the message body, unless
+	    // in privacy mode. The handler runs asynchronously, so every
+	    // message gets its own slice rather than sharing a buffer with
+	    // the next transaction.
+	    message := data
+	    if !s.srv.NoReceived {
+		message = append(s.makeHeaders(to), data...)
+	    }
+
+	    // With all handler slots busy, hold the reply back until one
+	    // is free: the client waits instead of us piling up goroutines.
+	    // If it takes too long, ask the client to retry later.
+	    if !s.srv.acquireHandler() {
+		s.writef("451 Try again later (server busy)")
+		log.Printf("[ERR]: 451 All %d handlers busy, deferring mail from %s", s.srv.MaxHandlers, from)
+		s.accessMail(from, to, len(data), "busy")
+		from = ""
+		to = nil
+		s.sizeHint = 0
+		break
+	    }
+	    s.txid = newTxID()
+	    Debug( fmt.Sprintf("Sent: 250 Ok: queued as %s", s.txid) )
+	    s.writef("250 Ok: queued as %s", s.txid)
+	    statsMessage()
+	    s.messages++
+	    s.accessMail(from, to, len(data), "queued")
 
 	    // Pass mail on to handler.
-	    if s.srv.Handler != nil {
-		go s.srv.Handler(s.conn.RemoteAddr(), from, to, buffer.Bytes())
+	    spfTag := ""
+	    if s.spfTag {
+		spfTag = s.spfResult
 	    }
+	    go s.srv.runHandler(&Envelope{
+		RemoteAddr: s.remoteAddr,
+		LocalAddr:  s.conn.LocalAddr(),
+		Helo:       s.remoteName,
+		SPF:        spfTag,
+		Received:   received,
+		ID:         s.txid,
+		From:       from,
+		To:         to,
+		Data:       message,
+	    })
 
 	    // Reset for next mail.
 	    from = ""
 	    to = nil
-	    buffer.Reset()
+	    s.sizeHint = 0
+	    s.txid = ""
 	case "QUIT":
 	    Debug( fmt.Sprintf("221 %s %s SMTP Service closing transmission channel", s.srv.Hostname, s.srv.Appname) )
 	    s.writef("221 %s %s SMTP Service closing transmission channel", s.srv.Hostname, s.srv.Appname)
+	    result = "quit"
 	    break loop
 	case "RSET":
 	    Debug("RSET. 250 Ok")
 	    s.writef("250 Ok")
 	    from = ""
 	    to = nil
-	    buffer.Reset()
+	    s.sizeHint = 0
 	case "NOOP":
 	    Debug("NOOP: 250 Ok")
 	    s.writef("250 Ok")
-	case "HELP", "VRFY", "EXPN":
+	case "HELP":
+	    Debug( fmt.Sprintf("Received %s", verb ) )
+	    s.writeMulti(214, helpLines)
+	    Debug("Sent: 214 help")
+	case "VRFY", "EXPN":
 	    Debug( fmt.Sprintf("Received %s", verb ) )
 	    // See RFC 5321 section 4.2.4 for usage of 500 & 502 reply codes
 	    s.writef("502 Command not implemented")
@@ -241,9 +646,176 @@ loop:
     }
 }
 
+// Switch the connection to TLS after the 220 reply to STARTTLS.
+func (s *session) startTLS() error {
+    conn := tls.Server(s.conn, s.srv.TLSConfig)
+    if err := conn.Handshake(); err != nil {
+	return err
+    }
+    s.conn = conn
+    s.br = bufio.NewReader(conn)
+    s.bw = bufio.NewWriter(conn)
+    s.tls = true
+    return nil
+}
+
+// Look the client hostname up, sending the result (or "unknown") to s.ptr.
+func (s *session) lookupHost() {
+    resolver := s.srv.Resolver
+    if resolver == nil {
+	resolver = net.DefaultResolver
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    names, err := resolver.LookupAddr(ctx, s.remoteIP)
+    cancel()
+    if err == nil && len(names) > 0 {
+	s.ptr <- names[0]
+    } else {
+	s.ptr <- "unknown"
+    }
+}
+
+// Return the client hostname if the reverse lookup finished already,
+// "unknown" otherwise: a slow DNS server isn't worth holding mail for.
+func (s *session) host() string {
+    if s.remoteHost == "" {
+	select {
+	case name := <-s.ptr:
+	    s.remoteHost = name
+	default:
+	    return "unknown"
+	}
+    }
+    return s.remoteHost
+}
+
+// Hold the banner back for GreetPause. Well behaved clients wait for it,
+// spam bots often start sending right away: returns false if the client
+// did, or went away meanwhile.
+func (s *session) greetPause() bool {
+    if s.srv.GreetPause <= 0 {
+	return true
+    }
+    s.conn.SetReadDeadline(time.Now().Add(s.srv.GreetPause))
+    _, err := s.br.Peek(1)
+    s.conn.SetReadDeadline(time.Time{})
+    if err == nil {
+	s.writef("554 %s SMTP synchronization error", s.srv.Hostname)
+	log.Printf("[ERR]: %s (%s) talked before the banner, dropping connection", s.remoteIP, s.host())
+	return false
+    }
+    if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+	return true
+    }
+    return false
+}
+
+// Count a command, and tell the client to go away if it sent more than
+// MaxCmdRate in the current second: a client looping on NOOP or RSET
+// shouldn't keep a session spinning.
+func (s *session) commandFlood() bool {
+    if s.srv.MaxCmdRate <= 0 {
+	return false
+    }
+    now := time.Now()
+    if now.Sub(s.cmdSecond) >= time.Second {
+	s.cmdSecond, s.cmds = now, 0
+    }
+    s.cmds++
+    if s.cmds <= s.srv.MaxCmdRate {
+	return false
+    }
+    s.writef("421 Too many commands, closing connection")
+    log.Printf("[ERR]: 421 %s sent more than %d commands per second, closing connection", s.remoteIP, s.srv.MaxCmdRate)
+    return true
+}
+
+// Count a refused RCPT. Once the client had MaxBadRcpts of them, as
+// dictionary attacks do, tell it 421 and report the session should end.
+func (s *session) refusedRcpt() bool {
+    s.rcptsRefused++
+    if s.srv.MaxBadRcpts <= 0 || s.rcptsRefused < s.srv.MaxBadRcpts {
+	return false
+    }
+    s.writef("421 Too many refused recipients, closing connection")
+    log.Printf("[ERR]: 421 %s had %d RCPT refused, closing connection", s.remoteIP, s.rcptsRefused)
+    return true
+}
+
+// Report whether rcpt is already in to. The domain part of addresses is
+// case-insensitive, the local part is compared as is (RFC 5321 section 2.4).
+func hasRecipient(to []string, rcpt string) bool {
+    key := recipientKey(rcpt)
+    for _, addr := range to {
+	if recipientKey(addr) == key {
+	    return true
+	}
+    }
+    return false
+}
+
+func recipientKey(addr string) string {
+    addr = strings.Trim(strings.TrimSpace(addr), "<>")
+    if i := strings.LastIndex(addr, "@"); i >= 0 {
+	return addr[:i] + strings.ToLower(addr[i:])
+    }
+    return addr
+}
+
+// Write a line to the access log, prefixed with the time.
+func (s *session) access(format string, args ...interface{}) {
+    if s.srv.AccessLog == nil {
+	return
+    }
+    line := time.Now().Format(time.RFC3339) + " " + fmt.Sprintf(format, args...) + "\n"
+    s.srv.accessMu.Lock()
+    io.WriteString(s.srv.AccessLog, line)
+    s.srv.accessMu.Unlock()
+}
+
+// Write the access log line of a transaction.
+func (s *session) accessMail(from string, to []string, size int, result string) {
+    if s.txid != "" {
+	result += " id=" + s.txid
+    }
+    s.access("event=mail remote=%s helo=%q from=%q to=%q size=%d result=%s", s.remoteIP, s.remoteName, from, strings.Join(to, ","), size, result)
+}
+
+// Make an id for a queued mail, told to the client and passed on to the
+// handler, so the mail can be followed through the logs.
+func newTxID() string {
+    b := make([]byte, 6)
+    if _, err := rand.Read(b); err != nil {
+	return strconv.FormatInt(time.Now().UnixNano(), 36)
+    }
+    return strings.ToUpper(hex.EncodeToString(b))
+}
+
 // Wrapper function for writing a complete line to the socket.
 func (s *session) writef(format string, args ...interface{}) {
-    fmt.Fprintf(s.bw, format+"\r\n", args...)
+    line := fmt.Sprintf(format, args...)
+    if s.enhanced {
+	line = s.enhance(line)
+    }
+    fmt.Fprintf(s.bw, "%s\r\n", line)
+    s.bw.Flush()
+}
+
+// Write a multi-line reply: all lines but the last are sent as
+// continuation lines ("214-...") as RFC 5321 section 4.2.1 requires.
+// Each line carries the enhanced code, but for the EHLO reply: it lists
+// the extensions, ENHANCEDSTATUSCODES among them (RFC 2034 section 3).
+func (s *session) writeMulti(code int, lines []string) {
+    for i, line := range lines {
+	line = fmt.Sprintf("%d %s", code, line)
+	if s.enhanced && s.verb != "EHLO" {
+	    line = s.enhance(line)
+	}
+	if i < len(lines)-1 {
+	    line = line[:3] + "-" + line[4:]
+	}
+	fmt.Fprintf(s.bw, "%s\r\n", line)
+    }
     s.bw.Flush()
 }
 
@@ -253,7 +825,9 @@ func (s *session) readLine() (string, error) {
     if err != nil {
 	return "", err
     }
-    line = strings.TrimSpace(line) // Strip trailing \r\n
+    // Strip only the line terminator, trailing spaces may be part of
+    // the arguments (e.g. AUTH payloads).
+    line = strings.TrimRight(line, "\r\n")
     return line, err
 }
 
@@ -261,7 +835,7 @@ func (s *session) readLine() (string, error) {
 func (s *session) parseLine(line string) (verb string, args string) {
     if idx := strings.Index(line, " "); idx != -1 {
 	verb = strings.ToUpper(line[:idx])
-	args = strings.TrimSpace(line[idx+1:])
+	args = strings.TrimLeft(line[idx+1:], " ")
     } else {
 	verb = strings.ToUpper(line)
 	args = ""
@@ -271,24 +845,100 @@ func (s *session) parseLine(line string) (verb string, args string) {
 
 // Read the message data following a DATA command.
 func (s *session) readData() ([]byte, error) {
-    var data []byte
+    // Size the buffer once from the SIZE hint, rather than growing it
+    // line by line. Don't trust the client with more than maxSizeHint
+    // up front, past it the buffer grows with the data actually sent.
+    var data bytes.Buffer
+    if hint := s.sizeHint; hint > 0 {
+	if hint > maxSizeHint {
+	    hint = maxSizeHint
+	}
+	data.Grow(hint)
+    }
+    lineStart := true
     for {
-	line, err := s.br.ReadBytes('\n')
-	if err != nil {
+	// Lines longer than the reader buffer come in several pieces,
+	// only the first one is a line start.
+	line, err := s.br.ReadSlice('\n')
+	if err != nil && err != bufio.ErrBufferFull {
 	    return nil, err
 	}
-	// Handle end of data denoted by lone period (\r\n.\r\n)
-	if bytes.Equal(line, []byte(".\r\n")) {
-	    break
+	// Nothing to index into, don't let a crafted stream crash the session.
+	if len(line) == 0 {
+	    continue
+	}
+	if lineStart {
+	    // Handle end of data denoted by lone period (\r\n.\r\n)
+	    if err == nil && bytes.Equal(line, []byte(".\r\n")) {
+		break
+	    }
+	    // Remove leading period (RFC 5321 section 4.5.2)
+	    if len(line) > 1 && line[0] == '.' {
+		line = line[1:]
+	    }
 	}
-	// Remove leading period (RFC 5321 section 4.5.2)
-	if line[0] == '.' {
-	    line = line[1:]
+	data.Write(line)
+	lineStart = err == nil
+    }
+    return data.Bytes(), nil
+}
+
+// Report whether the mail has no body: it is blank, or made of header
+// lines only, with or without the empty line ending them.
+func emptyMessage(data []byte) bool {
+    lines := strings.Split(strings.Replace(string(data), "\r\n", "\n", -1), "\n")
+    for i, line := range lines {
+	if strings.TrimSpace(line) == "" {
+	    // End of headers: is anything left?
+	    return strings.TrimSpace(strings.Join(lines[i:], "\n")) == ""
+	}
+	if !headerLineRE.MatchString(line) {
+	    return false
+	}
+    }
+    return true
+}
+
+// Split the MAIL FROM argument into the address and the SIZE parameter
+// (RFC 1870), 0 if missing or invalid.
+func mailParams(arg string) (string, int) {
+    fields := strings.Fields(arg)
+    if len(fields) == 0 {
+	return "", 0
+    }
+    size := 0
+    for _, param := range fields[1:] {
+	if strings.HasPrefix(strings.ToUpper(param), "SIZE=") {
+	    size, _ = strconv.Atoi(param[5:])
 	}
-	data = append(data, line...)
+    }
+    return fields[0], size
+}
 
+// Debug-log the extended parameters (SIZE=, BODY=, AUTH=...) following
+// the address of a MAIL or RCPT command, if the client sent any.
+func debugParams(verb string, arg string) {
+    fields := strings.Fields(arg)
+    if len(fields) < 2 {
+	return
     }
-    return data, nil
+    Debug( fmt.Sprintf("%s parameters: %s", verb, strings.Join(fields[1:], " ")) )
+}
+
+// Strip the source route of a legacy "<@relay1,@relay2:user@domain>"
+// path, keeping "<user@domain>": RFC 5321 section 4.1.1.3 lets servers
+// ignore it.
+func stripSourceRoute(path string) string {
+    path = strings.TrimSpace(path)
+    if !strings.HasPrefix(path, "<@") {
+	return path
+    }
+    idx := strings.Index(path, ":")
+    if idx == -1 {
+	return path
+    }
+    Debug( fmt.Sprintf("Ignoring source route %s", path[1:idx]) )
+    return "<" + path[idx+1:]
 }
 
 // Create the Received header to comply with RFC 2821 section 3.8.2.
@@ -296,12 +946,20 @@ func (s *session) readData() ([]byte, error) {
 func (s *session) makeHeaders(to []string) []byte {
     var buffer bytes.Buffer
     now := time.Now().Format("Mon, _2 Jan 2006 15:04:05 -0700 (MST)")
-    buffer.WriteString(fmt.Sprintf("Received: from %s (%s [%s])\r\n", s.remoteName, s.remoteHost, s.remoteIP))
+    buffer.WriteString(fmt.Sprintf("Received: from %s (%s [%s])\r\n", s.remoteName, s.host(), s.remoteIP))
     buffer.WriteString(fmt.Sprintf("        by %s (%s) with SMTP\r\n", s.srv.Hostname, s.srv.Appname))
     buffer.WriteString(fmt.Sprintf("        for <%s>; %s\r\n", to[0], now))
+    if s.spfResult != "" {
+	buffer.WriteString(fmt.Sprintf("Received-SPF: %s client-ip=%s; helo=%s\r\n", s.spfResult, s.remoteIP, s.remoteName))
+    }
     return buffer.Bytes()
 }
 
+// SetDebug enables or disables debug logging.
+func SetDebug(dbg bool) {
+    debug = dbg
+}
+
 func Debug(msg string) {
     if( debug == true ) {
 	log.Printf( "[DEBUG] %s", msg )
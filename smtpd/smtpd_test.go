@@ -0,0 +1,219 @@
+package smtpd_test
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "io/ioutil"
+    "log"
+    "net"
+    "net/smtp"
+    "os"
+    "regexp"
+    "sort"
+    "strings"
+    "testing"
+    "time"
+    "github.com/ircop/smtp2tg/smtpd"
+    "github.com/ircop/smtp2tg/smtpd/smtpdtest"
+)
+
+// noDNS fails every DNS query at once: sessions look up the client's host
+// name in the background, tests shouldn't wait on real DNS.
+var noDNS = &net.Resolver{
+    PreferGo: true,
+    Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return nil, errors.New("no DNS in tests")
+    },
+}
+
+// send runs one MAIL/RCPT/DATA transaction on an open client.
+func send(c *smtp.Client, from string, to string, data []byte) error {
+    if err := c.Mail(from); err != nil {
+	return err
+    }
+    if err := c.Rcpt(to); err != nil {
+	return err
+    }
+    w, err := c.Data()
+    if err != nil {
+	return err
+    }
+    if _, err = w.Write(data); err != nil {
+	return err
+    }
+    return w.Close()
+}
+
+// Two transactions on one session each get their own envelope, the second
+// one reusing none of the first one's buffers.
+func TestTwoTransactions(t *testing.T) {
+    for _, noReceived := range []bool{true, false} {
+	h := &smtpdtest.RecordingHandler{}
+	srv := &smtpd.Server{Handler: h.Handle, Hostname: "mx.test", NoReceived: noReceived, Resolver: noDNS}
+	client, server := net.Pipe()
+	go srv.ServeConn(server)
+
+	c, err := smtp.NewClient(client, "localhost")
+	if err != nil {
+	    t.Fatal(err)
+	}
+	if err = c.Hello("client.test"); err != nil {
+	    t.Fatal(err)
+	}
+	first := []byte("Subject: one\r\n\r\nfirst body\r\n")
+	second := []byte("Subject: two\r\n\r\nsecond, longer body\r\n")
+	if err = send(c, "a@example.com", "x@example.org", first); err != nil {
+	    t.Fatalf("first transaction: %s", err)
+	}
+	if err = send(c, "b@example.com", "y@example.org", second); err != nil {
+	    t.Fatalf("second transaction: %s", err)
+	}
+	if err = c.Quit(); err != nil {
+	    t.Fatal(err)
+	}
+
+	envs, err := h.Wait(2, 5*time.Second)
+	if err != nil {
+	    t.Fatal(err)
+	}
+	// Handlers run concurrently, put the envelopes back in order.
+	sort.Slice(envs, func(i, j int) bool { return envs[i].From < envs[j].From })
+	want := []struct {
+	    from string
+	    to   string
+	    data []byte
+	}{
+	    {"<a@example.com>", "<x@example.org>", first},
+	    {"<b@example.com>", "<y@example.org>", second},
+	}
+	for i, w := range want {
+	    env := envs[i]
+	    if env.From != w.from || len(env.To) != 1 || env.To[0] != w.to {
+		t.Errorf("envelope %d: from %q to %q, want from %q to %q", i, env.From, env.To, w.from, w.to)
+	    }
+	    if env.Helo != "client.test" {
+		t.Errorf("envelope %d: helo %q", i, env.Helo)
+	    }
+	    if noReceived && !bytes.Equal(env.Data, w.data) || !bytes.HasSuffix(env.Data, w.data) {
+		t.Errorf("envelope %d (NoReceived %v): data %q, want %q", i, noReceived, env.Data, w.data)
+	    }
+	}
+	if envs[0].ID == "" || envs[0].ID == envs[1].ID {
+	    t.Errorf("transaction ids %q and %q", envs[0].ID, envs[1].ID)
+	}
+    }
+}
+
+// fuzzConn is a connection reading a canned client script and recording
+// the replies. The session ends at the end of the script.
+type fuzzConn struct {
+    in  *bytes.Reader
+    out bytes.Buffer
+}
+
+func (c *fuzzConn) Read(b []byte) (int, error)         { return c.in.Read(b) }
+func (c *fuzzConn) Write(b []byte) (int, error)        { return c.out.Write(b) }
+func (c *fuzzConn) Close() error                       { return nil }
+func (c *fuzzConn) LocalAddr() net.Addr                { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 25} }
+func (c *fuzzConn) RemoteAddr() net.Addr               { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000} }
+func (c *fuzzConn) SetDeadline(t time.Time) error      { return nil }
+func (c *fuzzConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *fuzzConn) SetWriteDeadline(t time.Time) error { return nil }
+
+var replyRE = regexp.MustCompile(`^\d{3}[ -]`)
+
+// Whatever the client sends, the session doesn't panic and only writes
+// well-formed reply lines.
+func FuzzSession(f *testing.F) {
+    for _, script := range []string{
+	"EHLO client.test\r\nMAIL FROM:<a@example.com> SIZE=100\r\nRCPT TO:<b@example.org>\r\nDATA\r\nSubject: x\r\n\r\nbody\r\n.\r\nQUIT\r\n",
+	"HELO client.test\r\nMAIL FROM:<>\r\nRCPT TO:<@relay.test:b@example.org>\r\nRSET\r\nNOOP\r\nHELP\r\nQUIT\r\n",
+	"EHLO x\r\nMAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.org>\r\nDATA\r\n..dot\r\n",
+	"DATA\r\nRCPT TO:<b@example.org>\r\nMAIL\r\nAUTH PLAIN\r\nSTARTTLS\r\nVRFY x\r\n\r\n",
+	"EHLO x\nMAIL FROM:<a@example.com> BODY=8BITMIME\nRCPT TO:b@example.org\nDATA\n\x00\xff\n.\n",
+    } {
+	f.Add([]byte(script))
+    }
+    log.SetOutput(ioutil.Discard)
+    f.Cleanup(func() { log.SetOutput(os.Stderr) })
+    f.Fuzz(func(t *testing.T, script []byte) {
+	srv := &smtpd.Server{Hostname: "mx.test", EnhancedCodes: true, MaxConnRcpts: 5, MaxBadRcpts: 3, Resolver: noDNS}
+	conn := &fuzzConn{in: bytes.NewReader(script)}
+	srv.ServeConn(conn)
+
+	out := conn.out.String()
+	if !strings.HasSuffix(out, "\r\n") {
+	    t.Fatalf("unterminated reply: %q", out)
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(out, "\r\n"), "\r\n") {
+	    if !replyRE.MatchString(line) {
+		t.Fatalf("malformed reply line %q", line)
+	    }
+	}
+    })
+}
+
+// With AllowedHelo set, skipping EHLO/HELO doesn't get past it.
+func TestAllowedHeloWithoutHelo(t *testing.T) {
+    srv := &smtpd.Server{Hostname: "mx.test", AllowedHelo: []string{"*.example.com"}, Resolver: noDNS}
+    conn := &fuzzConn{in: bytes.NewReader([]byte("MAIL FROM:<a@example.com>\r\nQUIT\r\n"))}
+    srv.ServeConn(conn)
+    lines := strings.Split(conn.out.String(), "\r\n")
+    if len(lines) < 2 || !strings.HasPrefix(lines[1], "503 ") {
+	t.Errorf("MAIL without EHLO got %q, want 503", lines)
+    }
+}
+
+// Go shares the handler slots with sessions, and gives up after
+// HandlerWait when they stay busy.
+func TestGoHandlerSlots(t *testing.T) {
+    srv := &smtpd.Server{Hostname: "mx.test", MaxHandlers: 1, HandlerWait: 20 * time.Millisecond}
+    release := make(chan struct{})
+    if !srv.Go(func() { <-release }) {
+	t.Fatal("no slot for the first call")
+    }
+    if srv.Go(func() {}) {
+	t.Error("second call run with the only slot busy")
+    }
+    close(release)
+    done := make(chan struct{})
+    deadline := time.Now().Add(5 * time.Second)
+    for !srv.Go(func() { close(done) }) {
+	if time.Now().After(deadline) {
+	    t.Fatal("slot never released")
+	}
+    }
+    <-done
+}
+
+// With EnhancedCodes, replies after EHLO carry enhanced codes, each line
+// of a multi-line one too, but for the EHLO reply itself.
+func TestEnhancedCodes(t *testing.T) {
+    srv := &smtpd.Server{Hostname: "mx.test", EnhancedCodes: true, Resolver: noDNS}
+    conn := &fuzzConn{in: bytes.NewReader([]byte("EHLO client.test\r\nHELP\r\nNOOP\r\nQUIT\r\n"))}
+    srv.ServeConn(conn)
+    var ehlo, help []string
+    for _, line := range strings.Split(conn.out.String(), "\r\n") {
+	switch {
+	case strings.HasPrefix(line, "250-"):
+	    ehlo = append(ehlo, line)
+	case strings.HasPrefix(line, "214"):
+	    help = append(help, line)
+	}
+    }
+    if len(ehlo) == 0 || strings.Contains(strings.Join(ehlo, "\n"), "2.0.0") {
+	t.Errorf("EHLO reply %q, want extensions without enhanced codes", ehlo)
+    }
+    if len(help) == 0 {
+	t.Fatal("no HELP reply")
+    }
+    for _, line := range help {
+	if line[4:10] != "2.0.0 " {
+	    t.Errorf("HELP reply line %q without enhanced code", line)
+	}
+    }
+    if out := conn.out.String(); !strings.Contains(out, "\r\n250 2.0.0 ") {
+	t.Errorf("NOOP reply without enhanced code in %q", out)
+    }
+}
@@ -0,0 +1,100 @@
+// Package smtpdtest provides helpers for end-to-end tests of smtpd handlers.
+package smtpdtest
+
+import (
+    "fmt"
+    "net"
+    "net/smtp"
+    "sync"
+    "time"
+    "github.com/ircop/smtp2tg/smtpd"
+)
+
+// Envelope is a mail passed to a RecordingHandler.
+type Envelope = smtpd.Envelope
+
+// RecordingHandler keeps the mails it is called with.
+type RecordingHandler struct {
+    mu        sync.Mutex
+    envelopes []Envelope
+    added     chan struct{}
+}
+
+// Handle records the mail, it is an smtpd.Handler.
+func (h *RecordingHandler) Handle(env *smtpd.Envelope) {
+    h.mu.Lock()
+    h.envelopes = append(h.envelopes, *env)
+    added := h.added
+    h.added = nil
+    h.mu.Unlock()
+    if added != nil {
+	close(added)
+    }
+}
+
+// Envelopes returns the mails recorded so far.
+func (h *RecordingHandler) Envelopes() []Envelope {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    return append([]Envelope(nil), h.envelopes...)
+}
+
+// Wait waits until at least n mails were recorded and returns them.
+// Handlers run asynchronously, so this is needed after Send.
+func (h *RecordingHandler) Wait(n int, timeout time.Duration) ([]Envelope, error) {
+    deadline := time.After(timeout)
+    for {
+	h.mu.Lock()
+	if len(h.envelopes) >= n {
+	    envelopes := append([]Envelope(nil), h.envelopes...)
+	    h.mu.Unlock()
+	    return envelopes, nil
+	}
+	if h.added == nil {
+	    h.added = make(chan struct{})
+	}
+	added := h.added
+	h.mu.Unlock()
+
+	select {
+	case <-added:
+	case <-deadline:
+	    return h.Envelopes(), fmt.Errorf("got %d mails, want %d", len(h.Envelopes()), n)
+	}
+    }
+}
+
+// Send delivers a canned mail through a session of srv served over an
+// in-memory net.Pipe connection, the same way a client would.
+func Send(srv *smtpd.Server, from string, to []string, data []byte) error {
+    client, server := net.Pipe()
+    defer client.Close()
+    go srv.ServeConn(server)
+
+    c, err := smtp.NewClient(client, "localhost")
+    if err != nil {
+	return err
+    }
+    if err = c.Hello("localhost"); err != nil {
+	return err
+    }
+    if err = c.Mail(from); err != nil {
+	return err
+    }
+    for _, rcpt := range to {
+	if err = c.Rcpt(rcpt); err != nil {
+	    return err
+	}
+    }
+    w, err := c.Data()
+    if err != nil {
+	return err
+    }
+    if _, err = w.Write(data); err != nil {
+	return err
+    }
+    if err = w.Close(); err != nil {
+	return err
+    }
+    return c.Quit()
+}
@@ -0,0 +1,73 @@
+package smtpdtest
+
+import (
+    "bytes"
+    "testing"
+    "time"
+    "github.com/ircop/smtp2tg/smtpd"
+)
+
+func TestSend(t *testing.T) {
+    h := &RecordingHandler{}
+    srv := &smtpd.Server{Handler: h.Handle, Hostname: "mx.test", NoReceived: true}
+    data := []byte("Subject: test\r\n\r\nhello\r\n")
+    if err := Send(srv, "a@example.com", []string{"b@example.org", "c@example.org"}, data); err != nil {
+	t.Fatal(err)
+    }
+    envs, err := h.Wait(1, 5*time.Second)
+    if err != nil {
+	t.Fatal(err)
+    }
+    if len(envs) != 1 {
+	t.Fatalf("got %d mails, want 1", len(envs))
+    }
+    env := envs[0]
+    if env.From != "<a@example.com>" {
+	t.Errorf("from %q", env.From)
+    }
+    if len(env.To) != 2 || env.To[0] != "<b@example.org>" || env.To[1] != "<c@example.org>" {
+	t.Errorf("to %q", env.To)
+    }
+    if !bytes.Equal(env.Data, data) {
+	t.Errorf("data %q, want %q", env.Data, data)
+    }
+    if got := h.Envelopes(); len(got) != 1 {
+	t.Errorf("Envelopes returned %d mails, want 1", len(got))
+    }
+}
+
+// Wait returns as soon as enough mails are recorded, even if they come
+// in while it waits.
+func TestWaitLater(t *testing.T) {
+    h := &RecordingHandler{}
+    go func() {
+	for i := 0; i < 2; i++ {
+	    time.Sleep(10 * time.Millisecond)
+	    h.Handle(&smtpd.Envelope{ID: "x"})
+	}
+    }()
+    envs, err := h.Wait(2, 5*time.Second)
+    if err != nil {
+	t.Fatal(err)
+    }
+    if len(envs) != 2 {
+	t.Errorf("got %d mails, want 2", len(envs))
+    }
+}
+
+// Wait gives up after the timeout with the mails recorded so far.
+func TestWaitTimeout(t *testing.T) {
+    h := &RecordingHandler{}
+    h.Handle(&smtpd.Envelope{ID: "x"})
+    start := time.Now()
+    envs, err := h.Wait(2, 50*time.Millisecond)
+    if err == nil {
+	t.Fatal("no error for a missing mail")
+    }
+    if len(envs) != 1 {
+	t.Errorf("got %d mails, want the 1 recorded", len(envs))
+    }
+    if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+	t.Errorf("returned after %s, before the timeout", elapsed)
+    }
+}
@@ -0,0 +1,40 @@
+package smtpd
+
+import (
+    "fmt"
+    "log"
+    "net"
+    "strings"
+    "blitiri.com.ar/go/spf"
+)
+
+// Actions taken on mail by the SPF result of its MAIL FROM domain, see
+// Server.SPF.
+const (
+    SPFAllow  = "allow"  // Accept the mail as is
+    SPFTag    = "tag"    // Accept the mail, reporting the result in Envelope.SPF
+    SPFReject = "reject" // Refuse MAIL with 550
+)
+
+// Check the SPF record of the sender domain against the client address,
+// returning the result and the action Server.SPF gives for it. Bounces
+// (null sender) are checked against the EHLO name, as RFC 7208 section
+// 2.4 says.
+func (s *session) checkSPF(from string) (string, string) {
+    sender := strings.Trim(strings.TrimSpace(from), "<>")
+    if sender == "" {
+	sender = "postmaster@" + s.remoteName
+    }
+    result, err := spf.CheckHostWithSender(net.ParseIP(s.remoteIP), s.remoteName, sender)
+    if err != nil {
+	Debug( fmt.Sprintf("SPF check of %s for %s: %s", sender, s.remoteIP, err.Error()) )
+    }
+    action := s.srv.SPF[string(result)]
+    if action == "" {
+	action = SPFAllow
+    }
+    if action != SPFAllow {
+	log.Printf("SPF %s for %s from %s, %s", result, sender, s.remoteIP, action)
+    }
+    return string(result), action
+}
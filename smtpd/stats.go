@@ -0,0 +1,56 @@
+package smtpd
+
+import (
+    "sync"
+    "time"
+)
+
+// Stats is a snapshot of the server counters.
+type Stats struct {
+    Started        time.Time // Time the package was initialized
+    ActiveSessions int       // Currently open SMTP sessions
+    Connections    uint64    // Connections accepted since start
+    Messages       uint64    // Messages accepted since start
+    LastError      string    // Last error reported, empty if none
+    LastErrorTime  time.Time // Time of the last error
+}
+
+var (
+    statsMu sync.Mutex
+    stats   = Stats{Started: time.Now()}
+)
+
+// GetStats returns a consistent snapshot of the server counters.
+func GetStats() Stats {
+    statsMu.Lock()
+    defer statsMu.Unlock()
+    return stats
+}
+
+// SetLastError records msg as the last error, so handlers can report
+// delivery failures along with the server ones.
+func SetLastError(msg string) {
+    statsMu.Lock()
+    stats.LastError = msg
+    stats.LastErrorTime = time.Now()
+    statsMu.Unlock()
+}
+
+func statsSessionStart() {
+    statsMu.Lock()
+    stats.ActiveSessions++
+    stats.Connections++
+    statsMu.Unlock()
+}
+
+func statsSessionEnd() {
+    statsMu.Lock()
+    stats.ActiveSessions--
+    statsMu.Unlock()
+}
+
+func statsMessage() {
+    statsMu.Lock()
+    stats.Messages++
+    statsMu.Unlock()
+}
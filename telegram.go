@@ -0,0 +1,410 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/url"
+    "os"
+    "os/signal"
+    "strconv"
+    "strings"
+    "sync"
+    "syscall"
+    "time"
+    "github.com/spf13/viper"
+    "gopkg.in/telegram-bot-api.v4"
+)
+
+// MarkdownV2 parse mode, not known to the bot api package version we use.
+const modeMarkdownV2 = "MarkdownV2"
+
+// silent makes text messages arrive without notification by default.
+var silent bool
+
+// disablePreview keeps telegram from expanding links of relayed text.
+var disablePreview = true
+
+// messageTTLs maps receivers to the time their messages are deleted after.
+var messageTTLs = map[string]time.Duration{}
+
+// disableGoneChats stops sending to chats telegram says are gone (deleted,
+// bot blocked or removed) until SIGHUP or a restart.
+var disableGoneChats bool
+
+// replyAnchors maps receivers to the message their messages reply to.
+var replyAnchors = map[string]int{}
+
+// wraps maps receivers to the markup the text is wrapped in: spoiler or quote.
+var wraps map[string]string
+
+// telegramSender relays to telegram chats via the bot API.
+type telegramSender struct {
+    mu      sync.RWMutex
+    bot     *tgbotapi.BotAPI // Replaced by watch when re-authenticating
+    slots   chan struct{}    // Bounds in-flight API calls, unlimited if nil
+    gone    map[int64]string // Chats disabled by disableGoneChats, with the error
+    changed chan struct{}    // Closed when the bot is replaced, see botChanged
+}
+
+func (t *telegramSender) api() *tgbotapi.BotAPI {
+    t.mu.RLock()
+    defer t.mu.RUnlock()
+    return t.bot
+}
+
+func (t *telegramSender) setBot(bot *tgbotapi.BotAPI) {
+    t.mu.Lock()
+    t.bot = bot
+    if( t.changed != nil ) {
+	close(t.changed)
+	t.changed = nil
+    }
+    t.mu.Unlock()
+}
+
+// botChanged returns a channel closed when setBot replaces the bot.
+func (t *telegramSender) botChanged() <-chan struct{} {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    if( t.changed == nil ) {
+	t.changed = make(chan struct{})
+    }
+    return t.changed
+}
+
+// acquire waits for a free slot if calls are bounded, and returns the
+// function releasing it.
+func (t *telegramSender) acquire() func() {
+    if( t.slots == nil ) {
+	return func() {}
+    }
+    t.slots <- struct{}{}
+    return func() { <-t.slots }
+}
+
+// send makes the API call, waiting for a free slot if calls are bounded.
+func (t *telegramSender) send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+    defer t.acquire()()
+    return t.api().Send(c)
+}
+
+// sendToThread posts a text message to a forum topic. The bot api package
+// we use doesn't know message_thread_id, so the request is made by hand.
+func (t *telegramSender) sendToThread(c tgbotapi.MessageConfig, thread int) (tgbotapi.Message, error) {
+    params := url.Values{}
+    params.Set("chat_id", strconv.FormatInt(c.ChatID, 10))
+    params.Set("message_thread_id", strconv.Itoa(thread))
+    params.Set("text", c.Text)
+    if( c.ParseMode != "" ) {
+	params.Set("parse_mode", c.ParseMode)
+    }
+    params.Set("disable_notification", strconv.FormatBool(c.DisableNotification))
+    params.Set("disable_web_page_preview", strconv.FormatBool(c.DisableWebPagePreview))
+    if( c.ReplyToMessageID != 0 ) {
+	params.Set("reply_to_message_id", strconv.Itoa(c.ReplyToMessageID))
+    }
+    defer t.acquire()()
+    resp, err := t.api().MakeRequest("sendMessage", params)
+    return sentMessage(resp, err)
+}
+
+// uploadToThread sends a photo or document (field) to a forum topic.
+func (t *telegramSender) uploadToThread(method string, field string, id int64, thread int, reply int, name string, caption string, silent bool, data []byte) (tgbotapi.Message, error) {
+    params := map[string]string{
+	"chat_id":              strconv.FormatInt(id, 10),
+	"message_thread_id":    strconv.Itoa(thread),
+	"caption":              caption,
+	"disable_notification": strconv.FormatBool(silent),
+    }
+    if( reply != 0 ) {
+	params["reply_to_message_id"] = strconv.Itoa(reply)
+    }
+    defer t.acquire()()
+    resp, err := t.api().UploadFile(method, params, field, tgbotapi.FileBytes{Name: name, Bytes: data})
+    return sentMessage(resp, err)
+}
+
+// sentMessage decodes the message a hand made send request returned.
+func sentMessage(resp tgbotapi.APIResponse, err error) (tgbotapi.Message, error) {
+    var msg tgbotapi.Message
+    if( err != nil ) {
+	return msg, err
+    }
+    err = json.Unmarshal(resp.Result, &msg)
+    return msg, err
+}
+
+// expire schedules the deletion of a sent message after the receiver
+// message_ttl, if it has one. Telegram lets bots delete messages up to
+// 48 hours old, and pending deletions are lost on restart.
+func (t *telegramSender) expire(r *route, chat int64, msg tgbotapi.Message) {
+    ttl := messageTTL(r.Key)
+    if( ttl <= 0 ) {
+	return
+    }
+    time.AfterFunc(ttl, func() {
+	defer t.acquire()()
+	_, err := t.api().DeleteMessage(tgbotapi.DeleteMessageConfig{ChatID: chat, MessageID: msg.MessageID})
+	if( err != nil ) {
+	    logError("telegram delete of expired message %d for '%s': %s", msg.MessageID, r.Key, err.Error())
+	}
+    })
+}
+
+// messageTTL returns the message_ttl of the receiver key, or the wildcard one.
+func messageTTL(key string) time.Duration {
+    if ttl, ok := messageTTLs[key]; ok {
+	return ttl
+    }
+    return messageTTLs["*"]
+}
+
+// replyAnchor returns the message the receiver key replies to, or the
+// wildcard one, 0 if none.
+func replyAnchor(key string) int {
+    if id, ok := replyAnchors[key]; ok {
+	return id
+    }
+    return replyAnchors["*"]
+}
+
+// chatID returns the telegram chat id of the route.
+func chatID(r *route) (int64, error) {
+    id, err := strconv.ParseInt(r.Dest, 10, 64)
+    if( err != nil ) {
+	return 0, fmt.Errorf("wrong telegram id for '%s': not int64", r.Key)
+    }
+    return id, nil
+}
+
+// chat returns the telegram chat id of the route, or an error without
+// calling the API if the chat was disabled as gone.
+func (t *telegramSender) chat(r *route) (int64, error) {
+    id, err := chatID(r)
+    if( err != nil ) {
+	return 0, err
+    }
+    t.mu.RLock()
+    reason, gone := t.gone[id]
+    t.mu.RUnlock()
+    if( gone ) {
+	return 0, fmt.Errorf("chat %d for '%s' disabled until SIGHUP or restart: %s", id, r.Key, reason)
+    }
+    return id, nil
+}
+
+// goneError reports whether telegram refused the message because the chat
+// is gone for good: sending again won't help.
+func goneError(err error) bool {
+    msg := strings.ToLower(err.Error())
+    for _, s := range []string{"chat not found", "bot was blocked", "bot was kicked", "user is deactivated", "group chat was deleted"} {
+	if strings.Contains(msg, s) {
+	    return true
+	}
+    }
+    return false
+}
+
+// checkGone disables the chat if err says it is gone and disableGoneChats
+// is set, so it isn't sent to (and logged about) again and again.
+func (t *telegramSender) checkGone(r *route, id int64, err error) {
+    if( err == nil || !disableGoneChats || !goneError(err) ) {
+	return
+    }
+    t.mu.Lock()
+    if( t.gone == nil ) {
+	t.gone = map[int64]string{}
+    }
+    t.gone[id] = err.Error()
+    t.mu.Unlock()
+    log.Printf("Chat %d for '%s' is gone (%s), not sending to it until SIGHUP or restart", id, r.Key, err.Error())
+}
+
+// enableGoneOnSignal sends to the chats disabled as gone again on every
+// SIGHUP, once the bot was added back or unblocked.
+func (t *telegramSender) enableGoneOnSignal() {
+    sig := make(chan os.Signal, 1)
+    signal.Notify(sig, syscall.SIGHUP)
+    go func() {
+	for range sig {
+	    t.mu.Lock()
+	    n := len(t.gone)
+	    t.gone = nil
+	    t.mu.Unlock()
+	    if( n > 0 ) {
+		log.Printf("Sending to the %d chats disabled as gone again", n)
+	    }
+	}
+    }()
+}
+
+func (t *telegramSender) SendText(r *route, text string) error {
+    id, err := t.chat(r)
+    if( err != nil ) {
+	return err
+    }
+    tgMsg := tgbotapi.NewMessage(id, text)
+    tgMsg.ParseMode = tgbotapi.ModeMarkdown
+    // Still deliver in the receiver quiet hours, but don't ping.
+    tgMsg.DisableNotification = silent || isQuiet(r.Key)
+    tgMsg.DisableWebPagePreview = disablePreview
+    tgMsg.ReplyToMessageID = replyAnchor(r.Key)
+    mode := r.Wrap
+    if( mode == "" ) {
+	mode = textWrap(r.Key)
+    }
+    if( mode != "" ) {
+	tgMsg.Text = wrapMarkdownV2(text, mode)
+	tgMsg.ParseMode = modeMarkdownV2
+    }
+    post := func() error {
+	var sent tgbotapi.Message
+	var err error
+	if( r.Thread != 0 ) {
+	    sent, err = t.sendToThread(tgMsg, r.Thread)
+	} else {
+	    sent, err = t.send(tgMsg)
+	}
+	if( err == nil ) {
+	    t.expire(r, id, sent)
+	}
+	t.checkGone(r, id, err)
+	return err
+    }
+    err = post()
+    if( err != nil && entitiesError(err) ) {
+	// Markup telegram refuses (unbalanced, or too many entities):
+	// better deliver the content unformatted than not at all.
+	log.Printf("Telegram refused formatting for '%s' (%s), resending as plain text", r.Key, err.Error())
+	tgMsg.Text = text
+	tgMsg.ParseMode = ""
+	err = post()
+    }
+    return err
+}
+
+// entitiesError reports whether telegram refused the message because of
+// its formatting entities.
+func entitiesError(err error) bool {
+    msg := strings.ToLower(err.Error())
+    return strings.Contains(msg, "entities") || strings.Contains(msg, "entity")
+}
+
+func (t *telegramSender) SendPhoto(r *route, name string, data []byte) error {
+    // It's not a separate message, so disable notification
+    return t.sendPhoto(r, name, name, true, data)
+}
+
+// SendPhotoCaption sends the photo as the message itself, the text being
+// its caption.
+func (t *telegramSender) SendPhotoCaption(r *route, name string, caption string, data []byte) error {
+    return t.sendPhoto(r, name, caption, silent || isQuiet(r.Key), data)
+}
+
+func (t *telegramSender) sendPhoto(r *route, name string, caption string, silent bool, data []byte) error {
+    id, err := t.chat(r)
+    if( err != nil ) {
+	return err
+    }
+    var sent tgbotapi.Message
+    if( r.Thread != 0 ) {
+	sent, err = t.uploadToThread("sendPhoto", "photo", id, r.Thread, replyAnchor(r.Key), name, caption, silent, data)
+    } else {
+	tgMsg := tgbotapi.NewPhotoUpload(id, tgbotapi.FileBytes{Name: name, Bytes: data})
+	tgMsg.Caption = caption
+	tgMsg.DisableNotification = silent
+	tgMsg.ReplyToMessageID = replyAnchor(r.Key)
+	sent, err = t.send(tgMsg)
+    }
+    if( err == nil ) {
+	t.expire(r, id, sent)
+    }
+    t.checkGone(r, id, err)
+    return err
+}
+
+func (t *telegramSender) SendDocument(r *route, name string, data []byte) error {
+    id, err := t.chat(r)
+    if( err != nil ) {
+	return err
+    }
+    var sent tgbotapi.Message
+    if( r.Thread != 0 ) {
+	sent, err = t.uploadToThread("sendDocument", "document", id, r.Thread, replyAnchor(r.Key), name, name, true, data)
+    } else {
+	tgMsg := tgbotapi.NewDocumentUpload(id, tgbotapi.FileBytes{Name: name, Bytes: data})
+	tgMsg.Caption = name
+	tgMsg.DisableNotification = true
+	tgMsg.ReplyToMessageID = replyAnchor(r.Key)
+	sent, err = t.send(tgMsg)
+    }
+    if( err == nil ) {
+	t.expire(r, id, sent)
+    }
+    t.checkGone(r, id, err)
+    return err
+}
+
+// textWrap returns the wrap configured for the receiver key, or the wildcard one.
+func textWrap(key string) string {
+    if( wraps[key] != "" ) {
+	return wraps[key]
+    }
+    return wraps["*"]
+}
+
+// escapeMarkdownV2 escapes the characters reserved by the MarkdownV2 parse mode.
+func escapeMarkdownV2(text string) string {
+    var b strings.Builder
+    for _, r := range text {
+	if strings.ContainsRune("_*[]()~`>#+-=|{}.!\\", r) {
+	    b.WriteByte('\\')
+	}
+	b.WriteRune(r)
+    }
+    return b.String()
+}
+
+// wrapMarkdownV2 hides text behind a spoiler or sets it off as a blockquote.
+func wrapMarkdownV2(text string, mode string) string {
+    text = escapeMarkdownV2(text)
+    if( mode == "quote" ) {
+	return ">" + strings.Replace(text, "\n", "\n>", -1)
+    }
+    return "||" + text + "||"
+}
+
+// watch checks the bot with getMe every interval. After failures failed
+// checks in a row, the config is re-read and the bot re-created from the
+// (possibly rotated) token.
+func (t *telegramSender) watch(interval time.Duration, failures int) {
+    failed := 0
+    for range time.Tick(interval) {
+	_, err := t.api().GetMe()
+	if( err == nil ) {
+	    failed = 0
+	    continue
+	}
+	failed++
+	logError("telegram health check (%d/%d): %s", failed, failures, err.Error())
+	if( failed < failures ) {
+	    continue
+	}
+
+	if err := viper.ReadInConfig(); err != nil {
+	    logError("config reload: %s", err.Error())
+	}
+	bot, err := tgbotapi.NewBotAPI(viper.GetString("bot.token"))
+	if( err != nil ) {
+	    logError("telegram re-auth: %s", err.Error())
+	    continue
+	}
+	t.setBot(bot)
+	t.mu.Lock()
+	t.gone = nil
+	t.mu.Unlock()
+	failed = 0
+	log.Printf("Bot re-authorized as %s", bot.Self.UserName)
+    }
+}
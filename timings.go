@@ -0,0 +1,47 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+    "time"
+    "github.com/ircop/smtp2tg/smtpd"
+)
+
+// timings collects how long the stages of relaying a mail took, to find
+// the slow ones under load. Stages run more than once (a photo per image)
+// add up.
+type timings struct {
+    last   time.Time
+    order  []string
+    stages map[string]time.Duration
+}
+
+// newTimings starts timing from start, e.g. when DATA was received.
+func newTimings(start time.Time) *timings {
+    return &timings{last: start, stages: map[string]time.Duration{}}
+}
+
+// mark ends the named stage, which started when the previous one ended.
+func (t *timings) mark(stage string) {
+    now := time.Now()
+    if _, ok := t.stages[stage]; !ok {
+	t.order = append(t.order, stage)
+    }
+    t.stages[stage] += now.Sub(t.last)
+    t.last = now
+}
+
+func (t *timings) String() string {
+    parts := make([]string, len(t.order))
+    for i, stage := range t.order {
+	parts[i] = fmt.Sprintf("%s=%s", stage, t.stages[stage].Round(time.Millisecond))
+    }
+    return strings.Join(parts, " ")
+}
+
+// logTimings writes the timings of a mail to the debug log.
+func logTimings(t *timings) {
+    if( debug && t != nil && len(t.order) > 0 ) {
+	smtpd.Debug( fmt.Sprintf("timings: %s", t) )
+    }
+}
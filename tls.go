@@ -0,0 +1,96 @@
+package main
+
+import (
+    "crypto/tls"
+    "fmt"
+    "log"
+    "os"
+    "os/signal"
+    "strings"
+    "sync"
+    "syscall"
+    "github.com/spf13/viper"
+)
+
+// certStore holds the STARTTLS certificates, reloaded from their files
+// when they are renewed.
+type certStore struct {
+    certFile string
+    keyFile  string
+    sni      map[string][]string // Hostname to its [cert, key] files
+
+    mu      sync.RWMutex
+    primary *tls.Certificate
+    certs   map[string]*tls.Certificate
+}
+
+// load (re-)reads all certificate files. On error the certificates in
+// use are kept.
+func (c *certStore) load() error {
+    primary, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+    if( err != nil ) {
+	return fmt.Errorf("tls: %s", err.Error())
+    }
+    certs := map[string]*tls.Certificate{}
+    for host, files := range c.sni {
+	if( len(files) != 2 ) {
+	    return fmt.Errorf("tls.sni '%s': should be [cert, key]", host)
+	}
+	cert, err := tls.LoadX509KeyPair(files[0], files[1])
+	if( err != nil ) {
+	    return fmt.Errorf("tls.sni '%s': %s", host, err.Error())
+	}
+	certs[strings.ToLower(host)] = &cert
+    }
+    c.mu.Lock()
+    c.primary, c.certs = &primary, certs
+    c.mu.Unlock()
+    return nil
+}
+
+// getCertificate picks the certificate of the hostname the client asks
+// for (SNI), or the primary one.
+func (c *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+    if cert, ok := c.certs[strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))]; ok {
+	return cert, nil
+    }
+    return c.primary, nil
+}
+
+// reloadOnSignal reloads the certificates on every SIGHUP, so renewed
+// ones are used by new handshakes without a restart.
+func (c *certStore) reloadOnSignal() {
+    sig := make(chan os.Signal, 1)
+    signal.Notify(sig, syscall.SIGHUP)
+    go func() {
+	for range sig {
+	    if err := c.load(); err != nil {
+		logError("certificate reload: %s, keeping the current ones", err.Error())
+		continue
+	    }
+	    log.Printf("Certificates reloaded")
+	}
+    }()
+}
+
+// loadTLSConfig builds the STARTTLS config from tls.cert and tls.key, nil
+// if they aren't set. The [tls.sni] table gives certificates for other
+// hostnames: clients asking for one of them (SNI) get its certificate,
+// the others the primary one. SIGHUP reloads them all.
+func loadTLSConfig() (*tls.Config, error) {
+    store := &certStore{
+	certFile: viper.GetString("tls.cert"),
+	keyFile:  viper.GetString("tls.key"),
+	sni:      viper.GetStringMapStringSlice("tls.sni"),
+    }
+    if( store.certFile == "" && store.keyFile == "" ) {
+	return nil, nil
+    }
+    if err := store.load(); err != nil {
+	return nil, err
+    }
+    store.reloadOnSignal()
+    return &tls.Config{GetCertificate: store.getCertificate}, nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+    "regexp"
+    "strings"
+)
+
+// subjectTopics maps subject tags to the forum topic (message thread id)
+// of the receiver chat their mail goes to.
+var subjectTopics map[string]int
+
+var subjectTagRE = regexp.MustCompile(`^\s*\[([^\]]+)\]`)
+
+// subjectTopic returns the thread id for the leading "[tag]" of the
+// subject, 0 (the general topic) if it has none or the tag isn't mapped.
+func subjectTopic(subject string) int {
+    match := subjectTagRE.FindStringSubmatch(subject)
+    if match == nil {
+	return 0
+    }
+    // viper lowercases map keys, so compare lowercased.
+    return subjectTopics[strings.ToLower(strings.TrimSpace(match[1]))]
+}
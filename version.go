@@ -0,0 +1,18 @@
+package main
+
+import (
+    "fmt"
+    "runtime"
+)
+
+// Build info, injected at link time with -ldflags, see README.
+var (
+    version   = "dev"
+    commit    = "unknown"
+    buildDate = "unknown"
+)
+
+// versionLine describes the running build, for -version and the log.
+func versionLine() string {
+    return fmt.Sprintf("smtp2tg %s (commit %s, built %s, %s)", version, commit, buildDate, runtime.Version())
+}
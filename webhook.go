@@ -0,0 +1,115 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "log"
+    "mime/multipart"
+    "net/http"
+    "strings"
+    "time"
+    "github.com/spf13/viper"
+)
+
+var webhookClient = &http.Client{Timeout: 30 * time.Second}
+
+// postWebhook posts body to url and checks the response status.
+func postWebhook(url string, contentType string, body io.Reader) error {
+    resp, err := webhookClient.Post(url, contentType, body)
+    if( err != nil ) {
+	return err
+    }
+    defer resp.Body.Close()
+    if( resp.StatusCode < 200 || resp.StatusCode > 299 ) {
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("webhook returned %s: %s", resp.Status, string(msg))
+    }
+    return nil
+}
+
+// postJSON posts v encoded as json to url.
+func postJSON(url string, v interface{}) error {
+    payload, err := json.Marshal(v)
+    if( err != nil ) {
+	return err
+    }
+    return postWebhook(url, "application/json", bytes.NewReader(payload))
+}
+
+// slackEscaper escapes the characters slack reads as markup: mail text
+// must not ping the channel with <!channel> or <!here>.
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// slackSender relays to slack incoming webhooks. Those can't carry files,
+// so attachments are only mentioned by name.
+type slackSender struct{}
+
+func (slackSender) SendText(r *route, text string) error {
+    return postJSON(r.Dest, map[string]string{"text": slackEscaper.Replace(text)})
+}
+
+func (s slackSender) SendPhoto(r *route, name string, data []byte) error {
+    return s.SendDocument(r, name, data)
+}
+
+func (s slackSender) SendDocument(r *route, name string, data []byte) error {
+    log.Printf("Slack webhooks can't upload files, skipping attachment '%s' for '%s'", name, r.Key)
+    return s.SendText(r, fmt.Sprintf("Attachment '%s' (%d bytes) not relayed", name, len(data)))
+}
+
+// discordLimit is the longest message content discord accepts.
+const discordLimit = 2000
+
+// discordSender relays to discord webhooks.
+type discordSender struct{}
+
+// SendText posts the text, in several messages if it is too long, with
+// mentions (@everyone, @here, users and roles) left unparsed: mail text
+// must not ping the channel.
+func (discordSender) SendText(r *route, text string) error {
+    for _, chunk := range splitText(text, discordLimit) {
+	err := postJSON(r.Dest, map[string]interface{}{
+	    "content":          chunk,
+	    "allowed_mentions": map[string][]string{"parse": {}},
+	})
+	if( err != nil ) {
+	    return err
+	}
+    }
+    return nil
+}
+
+func (d discordSender) SendPhoto(r *route, name string, data []byte) error {
+    return d.SendDocument(r, name, data)
+}
+
+func (discordSender) SendDocument(r *route, name string, data []byte) error {
+    var buf bytes.Buffer
+    w := multipart.NewWriter(&buf)
+    fw, err := w.CreateFormFile("file", name)
+    if( err != nil ) {
+	return err
+    }
+    if _, err = fw.Write(data); err != nil {
+	return err
+    }
+    if err = w.Close(); err != nil {
+	return err
+    }
+    return postWebhook(r.Dest, w.FormDataContentType(), &buf)
+}
+
+// notifyAlert posts text to the alert.webhook url, if configured, so
+// operators learn about failures telegram can't tell them about.
+func notifyAlert(text string) {
+    url := viper.GetString("alert.webhook")
+    if( url == "" ) {
+	return
+    }
+    if err := postJSON(url, map[string]string{"text": text}); err != nil {
+	log.Printf("[ERROR]: alert webhook: %s", err.Error())
+    }
+}
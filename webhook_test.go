@@ -0,0 +1,62 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "github.com/ircop/smtp2tg/hooks"
+)
+
+// webhookRecorder is a webhook endpoint keeping the json posted to it.
+func webhookRecorder(t *testing.T) (*httptest.Server, *[]map[string]interface{}) {
+    var posts []map[string]interface{}
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	var v map[string]interface{}
+	if err := json.NewDecoder(req.Body).Decode(&v); err != nil {
+	    t.Errorf("webhook payload: %s", err)
+	}
+	posts = append(posts, v)
+    }))
+    t.Cleanup(srv.Close)
+    return srv, &posts
+}
+
+func TestSlackEscapesMentions(t *testing.T) {
+    srv, posts := webhookRecorder(t)
+    r := &route{Route: hooks.Route{Key: "*", Dest: srv.URL}}
+    if err := (slackSender{}).SendText(r, "<!channel> disk full & <b>"); err != nil {
+	t.Fatal(err)
+    }
+    if got, want := (*posts)[0]["text"], "&lt;!channel&gt; disk full &amp; &lt;b&gt;"; got != want {
+	t.Errorf("text %q, want %q", got, want)
+    }
+}
+
+func TestDiscordMentionsAndLimit(t *testing.T) {
+    srv, posts := webhookRecorder(t)
+    r := &route{Route: hooks.Route{Key: "*", Dest: srv.URL}}
+    text := "@everyone " + strings.Repeat("x", 2*discordLimit)
+    if err := (discordSender{}).SendText(r, text); err != nil {
+	t.Fatal(err)
+    }
+    if len(*posts) != 3 {
+	t.Fatalf("%d messages posted, want 3", len(*posts))
+    }
+    var joined string
+    for _, p := range *posts {
+	content := p["content"].(string)
+	if len(content) > discordLimit {
+	    t.Errorf("content of %d bytes", len(content))
+	}
+	joined += content
+	mentions, ok := p["allowed_mentions"].(map[string]interface{})
+	if !ok || len(mentions["parse"].([]interface{})) != 0 {
+	    t.Errorf("allowed_mentions %v, want no parsing", p["allowed_mentions"])
+	}
+    }
+    if joined != text {
+	t.Error("text changed by splitting")
+    }
+}